@@ -130,7 +130,9 @@ func (gossiper *Gossiper) handleTLCMessage() {
 					if hw3ex2Mode || hw3ex3Mode {
 						fmt.Println("SENDING ACK origin " + extPacket.Packet.TLCMessage.Origin + " ID " + fmt.Sprint(extPacket.Packet.TLCMessage.ID))
 					}
-					go gossiper.forwardPrivateMessage(&GossipPacket{Ack: privatePacket}, &privatePacket.HopLimit, privatePacket.Destination)
+					packetToSend := &GossipPacket{Ack: privatePacket}
+					gossiper.identityHandler.signPacket(packetToSend)
+					go gossiper.forwardPrivateMessage(packetToSend, &privatePacket.HopLimit, privatePacket.Destination)
 				}
 			}
 		}
@@ -213,6 +215,7 @@ func (gossiper *Gossiper) createTLCMessage(block BlockPublish, confirmedFlag int
 
 	tlcPacket := &TLCMessage{Origin: gossiper.Name, ID: id, TxBlock: block, VectorClock: gossiper.gossipHandler.myStatus.createMyStatusPacket(), Confirmed: confirmedFlag, Fitness: fitness}
 	extPacket := &ExtendedGossipPacket{Packet: &GossipPacket{TLCMessage: tlcPacket}, SenderAddr: gossiper.ConnectionHandler.GossiperData.Address}
+	gossiper.identityHandler.signPacket(extPacket.Packet)
 
 	// store message
 	gossiper.gossipHandler.storeMessage(extPacket.Packet, gossiper.Name, id)
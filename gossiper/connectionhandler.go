@@ -3,6 +3,7 @@ package gossiper
 import (
 	"fmt"
 	"net"
+	"sync"
 
 	"github.com/dedis/protobuf"
 	"github.com/mikanikos/Peerster/helpers"
@@ -12,28 +13,57 @@ import (
 type ConnectionHandler struct {
 	clientData   *ConnectionData
 	GossiperData *ConnectionData
+	// reassemble packets bigger than the mtu
+	fragmentHandler *FragmentHandler
+	// connections with peers if tcp is used
+	tcpTransport *TCPTransport
+	// encryption and authentication of the packets if links are secure
+	secureChannel *SecureChannel
+	// packets received from peers on any transport
+	incoming chan *receivedPacket
+	// peer -> traffic counters
+	counters sync.Map
 }
 
 // NewConnectionHandler creates new connection handler
 func NewConnectionHandler(gossiperAddress, clientAddress string) *ConnectionHandler {
 
-	// connection with other peers
-	gossiperData := createConnectionData(gossiperAddress)
+	// connection with other peers, no udp socket if only tcp is used
+	gossiperData := createConnectionData(gossiperAddress, transportMode != tcpMode)
 	// connection with client
-	clientData := createConnectionData(clientAddress)
+	clientData := createConnectionData(clientAddress, true)
 
-	return &ConnectionHandler{
-		clientData:   clientData,
-		GossiperData: gossiperData,
+	connectionHandler := &ConnectionHandler{
+		clientData:      clientData,
+		GossiperData:    gossiperData,
+		fragmentHandler: NewFragmentHandler(),
+		incoming:        make(chan *receivedPacket, maxChannelSize),
 	}
+
+	if transportMode != udpMode {
+		connectionHandler.tcpTransport = NewTCPTransport(gossiperData.Address, connectionHandler.incoming)
+	}
+
+	if linkPrivateKey != nil {
+		secureChannel, err := NewSecureChannel(linkPrivateKey, allowedLinkKeys, connectionHandler.writeFrame)
+		helpers.ErrorCheck(err, true)
+		connectionHandler.secureChannel = secureChannel
+		fmt.Println("Link public key: " + secureChannel.GetPublicKey())
+	}
+
+	return connectionHandler
 }
 
 // create Connection data
-func createConnectionData(addressString string) *ConnectionData {
+func createConnectionData(addressString string, listen bool) *ConnectionData {
 	// resolve gossiper address
 	address, err := net.ResolveUDPAddr("udp4", addressString)
 	helpers.ErrorCheck(err, true)
 
+	if !listen {
+		return &ConnectionData{Address: address}
+	}
+
 	// get connection for gossiper
 	connection, err := net.ListenUDP("udp4", address)
 	helpers.ErrorCheck(err, true)
@@ -73,33 +103,94 @@ func (gossiper *Gossiper) receivePacketsFromClient(clientChannel chan *helpers.M
 	}
 }
 
-// process incoming packets from other peers and send them dynamically to the appropriate channel for further processing
-func (gossiper *Gossiper) receivePacketsFromPeers() {
+// read datagrams from the udp socket
+func (connectionHandler *ConnectionHandler) receivePacketsFromUDP() {
 	for {
-		packetFromPeer := &GossipPacket{}
-		packetBytes := make([]byte, maxBufferSize)
+		packetBytes := make([]byte, maxDatagramSize)
 
 		// read from socket
-		n, addr, err := gossiper.ConnectionHandler.GossiperData.Connection.ReadFromUDP(packetBytes)
+		n, addr, err := connectionHandler.GossiperData.Connection.ReadFromUDP(packetBytes)
 		helpers.ErrorCheck(err, false)
-
-		if n > maxBufferSize {
-			maxBufferSize = maxBufferSize + n
+		if err != nil {
 			continue
 		}
 
-		// add peer
-		gossiper.AddPeer(addr)
+		connectionHandler.incoming <- &receivedPacket{data: packetBytes[:n], address: addr}
+	}
+}
+
+// process incoming packets from other peers and send them dynamically to the appropriate channel for further processing
+func (gossiper *Gossiper) receivePacketsFromPeers() {
+
+	// start receiving on the transports used
+	if gossiper.ConnectionHandler.GossiperData.Connection != nil {
+		go gossiper.ConnectionHandler.receivePacketsFromUDP()
+	}
+	if gossiper.ConnectionHandler.tcpTransport != nil {
+		go gossiper.ConnectionHandler.tcpTransport.acceptConnections()
+	}
+
+	for received := range gossiper.ConnectionHandler.incoming {
+		packetFromPeer := &GossipPacket{}
+		addr := received.address
+		packetBytes := received.data
+
+		// only accept authentic packets from peers with a secure link
+		if gossiper.ConnectionHandler.secureChannel != nil {
+			packetBytes = gossiper.ConnectionHandler.secureChannel.open(packetBytes, addr, received.tcp)
+			if packetBytes == nil {
+				continue
+			}
+		}
+
+		// traffic is only counted for known peers
+		if gossiper.isKnownPeer(addr) {
+			gossiper.ConnectionHandler.countReceived(addr, len(received.data))
+		}
 
 		// decode message
-		err = protobuf.Decode(packetBytes[:n], packetFromPeer)
+		err := protobuf.Decode(packetBytes, packetFromPeer)
 		helpers.ErrorCheck(err, false)
+		if err != nil {
+			continue
+		}
+
+		// if fragment, wait for the others and then decode the whole packet
+		if packetFromPeer.Fragment != nil {
+			wholePacket := gossiper.ConnectionHandler.fragmentHandler.addFragment(packetFromPeer.Fragment, addr)
+			if wholePacket == nil {
+				continue
+			}
+
+			packetFromPeer = &GossipPacket{}
+			err = protobuf.Decode(wholePacket, packetFromPeer)
+			helpers.ErrorCheck(err, false)
+			if err != nil || packetFromPeer.Fragment != nil {
+				continue
+			}
+		}
+
+		// drop forged or unsigned messages
+		if !gossiper.isAuthentic(packetFromPeer) {
+			continue
+		}
 
 		// get type of message and send it dynamically to the correct channel
 		modeType := getTypeFromGossip(packetFromPeer)
 
-		if modeType != "unknwon" {
+		if modeType != "unknown" {
 			if (modeType == "simple" && simpleMode) || (modeType != "simple" && !simpleMode) {
+				// add peer or mark it as alive only for valid packets
+				gossiper.markPeerAlive(addr, packetFromPeer)
+
+				// probes are answered by the gossiper that received them, the reply must come from its address
+				if packetFromPeer.Heartbeat != nil {
+					if !packetFromPeer.Heartbeat.Reply {
+						go gossiper.ConnectionHandler.SendPacket(&GossipPacket{Heartbeat: &Heartbeat{Reply: true}}, addr)
+					}
+					continue
+				}
+
 				packet := &ExtendedGossipPacket{Packet: packetFromPeer, SenderAddr: addr}
 				go func(p *ExtendedGossipPacket, m string) {
 					PacketChannels[m] <- p
@@ -118,9 +209,46 @@ func (connectionHandler *ConnectionHandler) SendPacket(packet *GossipPacket, add
 	packetToSend, err := protobuf.Encode(packet)
 	helpers.ErrorCheck(err, false)
 
-	// send message
-	_, err = connectionHandler.GossiperData.Connection.WriteToUDP(packetToSend, address)
-	helpers.ErrorCheck(err, false)
+	// use tcp if possible, udp until the connection is up or for peers not reachable with tcp
+	useTCP := transportMode == tcpMode || (transportMode == bothMode && connectionHandler.tcpTransport.isConnected(address))
+
+	if useTCP {
+		err = connectionHandler.sendFrame(packetToSend, address, true)
+		helpers.ErrorCheck(err, false)
+		return
+	}
+
+	// send message, fragmented if too big
+	connectionHandler.writePacket(packetToSend, address)
+}
+
+// forget the connection state kept for the peer
+func (connectionHandler *ConnectionHandler) removePeer(peer *net.UDPAddr) {
+	if connectionHandler.tcpTransport != nil {
+		connectionHandler.tcpTransport.closeConnection(peer)
+	}
+	if connectionHandler.secureChannel != nil {
+		connectionHandler.secureChannel.removePeer(peer)
+	}
+	connectionHandler.counters.Delete(peer.String())
+}
+
+// send frame to the peer, encrypted if links are secure
+func (connectionHandler *ConnectionHandler) sendFrame(frame []byte, address *net.UDPAddr, tcp bool) error {
+	if connectionHandler.secureChannel != nil {
+		return connectionHandler.secureChannel.send(frame, address, tcp)
+	}
+	return connectionHandler.writeFrame(frame, address, tcp)
+}
+
+// write frame to the peer with the given transport
+func (connectionHandler *ConnectionHandler) writeFrame(frame []byte, address *net.UDPAddr, tcp bool) error {
+	connectionHandler.countSent(address, len(frame))
+	if tcp {
+		return connectionHandler.tcpTransport.send(frame, address)
+	}
+	_, err := connectionHandler.GossiperData.Connection.WriteToUDP(frame, address)
+	return err
 }
 
 // broadcast message to all the known peers
@@ -0,0 +1,188 @@
+package gossiper
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DiscoveryHandler struct
+type DiscoveryHandler struct {
+	// nodes asked for peers when no peer is known
+	bootstrapPeers []*net.UDPAddr
+	// peer -> time of the last request, only replies to my requests are accepted
+	requests map[string]time.Time
+	mutex    sync.Mutex
+}
+
+// SetDiscovery sets the number of peers discovery tries to reach (0 to disable it) and the file with the bootstrap nodes, one ip:port per line
+func SetDiscovery(target uint, bootstrapFile string) error {
+	targetPeers = int(target)
+
+	if bootstrapFile == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(bootstrapFile)
+	if err != nil {
+		return err
+	}
+
+	peers := make([]string, 0)
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		_, err := net.ResolveUDPAddr("udp4", line)
+		if err != nil {
+			return fmt.Errorf("invalid bootstrap peer %s", line)
+		}
+		peers = append(peers, line)
+	}
+
+	bootstrapPeers = peers
+	return nil
+}
+
+// NewDiscoveryHandler create new discovery handler
+func NewDiscoveryHandler() *DiscoveryHandler {
+	addresses := make([]*net.UDPAddr, 0, len(bootstrapPeers))
+	for _, peer := range bootstrapPeers {
+		address, err := net.ResolveUDPAddr("udp4", peer)
+		if err == nil {
+			addresses = append(addresses, address)
+		}
+	}
+
+	return &DiscoveryHandler{
+		bootstrapPeers: addresses,
+		requests:       make(map[string]time.Time),
+	}
+}
+
+// record request sent to the peer
+func (discoveryHandler *DiscoveryHandler) markRequested(peer *net.UDPAddr) {
+	discoveryHandler.mutex.Lock()
+	defer discoveryHandler.mutex.Unlock()
+
+	discoveryHandler.requests[peer.String()] = time.Now()
+}
+
+// check if I asked the peer recently, only one reply per request is accepted
+func (discoveryHandler *DiscoveryHandler) isReplyExpected(peer *net.UDPAddr) bool {
+	discoveryHandler.mutex.Lock()
+	defer discoveryHandler.mutex.Unlock()
+
+	requestTime, loaded := discoveryHandler.requests[peer.String()]
+	if !loaded {
+		return false
+	}
+	delete(discoveryHandler.requests, peer.String())
+	return time.Since(requestTime) < discoveryTimeout
+}
+
+// forget requests that were never answered
+func (discoveryHandler *DiscoveryHandler) removeExpiredRequests() {
+	discoveryHandler.mutex.Lock()
+	defer discoveryHandler.mutex.Unlock()
+
+	for peer, requestTime := range discoveryHandler.requests {
+		if time.Since(requestTime) >= discoveryTimeout {
+			delete(discoveryHandler.requests, peer)
+		}
+	}
+}
+
+// periodically ask peers for other peers until there are enough
+func (gossiper *Gossiper) startPeerDiscovery() {
+	if targetPeers <= 0 {
+		return
+	}
+
+	gossiper.discoverPeers()
+
+	timer := time.NewTicker(discoveryTimeout)
+	for {
+		select {
+		case <-timer.C:
+			gossiper.discoveryHandler.removeExpiredRequests()
+			gossiper.discoverPeers()
+		}
+	}
+}
+
+// ask some random peers, or the bootstrap nodes if there are no peers, for the peers they know
+func (gossiper *Gossiper) discoverPeers() {
+	candidates := gossiper.GetPeers()
+	if len(candidates) >= targetPeers {
+		return
+	}
+
+	if len(candidates) == 0 {
+		candidates = gossiper.discoveryHandler.bootstrapPeers
+	}
+
+	for i, index := range rand.Perm(len(candidates)) {
+		if i == discoveryFanout {
+			break
+		}
+		gossiper.discoveryHandler.markRequested(candidates[index])
+		gossiper.ConnectionHandler.SendPacket(&GossipPacket{PeerExchange: &PeerExchange{Request: true}}, candidates[index])
+	}
+}
+
+// process peer exchange packets: answer requests and add the peers received
+func (gossiper *Gossiper) processPeerExchange() {
+	for extPacket := range PacketChannels["peerExchange"] {
+
+		if extPacket.Packet.PeerExchange.Request {
+			reply := &PeerExchange{Peers: gossiper.selectPeersToShare(extPacket.SenderAddr)}
+			go gossiper.ConnectionHandler.SendPacket(&GossipPacket{PeerExchange: reply}, extPacket.SenderAddr)
+
+		} else if gossiper.discoveryHandler.isReplyExpected(extPacket.SenderAddr) {
+			gossiper.addDiscoveredPeers(extPacket.Packet.PeerExchange.Peers)
+		}
+	}
+}
+
+// select some random peers to share, excluding the one who asked
+func (gossiper *Gossiper) selectPeersToShare(requester *net.UDPAddr) []string {
+	peers := gossiper.GetPeers()
+
+	selected := make([]string, 0)
+	for _, index := range rand.Perm(len(peers)) {
+		if len(selected) == maxExchangedPeers {
+			break
+		}
+		if peers[index].String() != requester.String() {
+			selected = append(selected, peers[index].String())
+		}
+	}
+	return selected
+}
+
+// add peers received until the target is reached
+func (gossiper *Gossiper) addDiscoveredPeers(peers []string) {
+	for i, peer := range peers {
+		if i == maxExchangedPeers || len(gossiper.GetPeers()) >= targetPeers {
+			return
+		}
+
+		address, err := net.ResolveUDPAddr("udp4", peer)
+		if err != nil || address.String() == gossiper.ConnectionHandler.GossiperData.Address.String() || gossiper.isKnownPeer(address) {
+			continue
+		}
+
+		// discovered peers are not verified, they never take the place of another peer
+		gossiper.addPeerWithDirection(address, false, false)
+
+		if debug {
+			fmt.Println("Discovered peer " + address.String())
+		}
+	}
+}
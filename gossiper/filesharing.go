@@ -15,6 +15,7 @@ func (gossiper *Gossiper) downloadDataFromPeer(fileName, peer string, hash []byt
 
 	// prepare data request
 	packet := &GossipPacket{DataRequest: &DataRequest{Origin: gossiper.Name, Destination: peer, HashValue: hash, HopLimit: uint32(hopLimit)}}
+	gossiper.identityHandler.signPacket(packet)
 
 	if hw2 {
 		printDownloadMessage(fileName, peer, hash, seqNum)
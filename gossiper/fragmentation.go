@@ -0,0 +1,233 @@
+package gossiper
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/dedis/protobuf"
+	"github.com/mikanikos/Peerster/helpers"
+)
+
+// fragmentKey identifies a packet being reassembled
+type fragmentKey struct {
+	address string
+	id      uint64
+}
+
+// fragmentSet collects the fragments of a packet until all of them arrive
+type fragmentSet struct {
+	fragments [][]byte
+	received  int
+	// bytes of the fragments received
+	size int
+	// time of the first fragment, used to discard incomplete sets
+	firstSeen time.Time
+}
+
+// peerFragments counts the packets being reassembled for a peer and their bytes
+type peerFragments struct {
+	sets int
+	size int
+}
+
+// FragmentHandler struct
+type FragmentHandler struct {
+	// sender address + packet id -> fragments received so far
+	fragmentSets map[fragmentKey]*fragmentSet
+	// sender address -> pending packets and bytes, so that a peer can't use all the room
+	peers map[string]*peerFragments
+	// bytes of all the pending fragments
+	size  int
+	mutex sync.Mutex
+}
+
+// NewFragmentHandler create new fragment handler
+func NewFragmentHandler() *FragmentHandler {
+	return &FragmentHandler{
+		fragmentSets: make(map[fragmentKey]*fragmentSet),
+		peers:        make(map[string]*peerFragments),
+	}
+}
+
+// SetMTU sets the maximum size of a datagram, bigger packets are fragmented
+func SetMTU(value uint) error {
+	if int(value) < minMTU || int(value) > maxDatagramSize {
+		return fmt.Errorf("mtu must be between %d and %d", minMTU, maxDatagramSize)
+	}
+	mtu = int(value)
+	return nil
+}
+
+// split encoded packet in fragments that fit in the given size, each one encoded in its own packet
+func createFragments(packetBytes []byte, maxSize int) ([][]byte, error) {
+	id := rand.Uint64()
+
+	// size of the fragment header with the biggest values, plus some bytes for the length of the data
+	header, err := protobuf.Encode(&GossipPacket{Fragment: &Fragment{ID: id, Index: math.MaxUint32, Count: math.MaxUint32}})
+	if err != nil {
+		return nil, err
+	}
+
+	fragmentSize := maxSize - len(header) - 8
+	if fragmentSize <= 0 {
+		return nil, fmt.Errorf("mtu too small for fragmentation")
+	}
+
+	count := (len(packetBytes) + fragmentSize - 1) / fragmentSize
+	if count > maxFragments || len(packetBytes) > maxFrameSize {
+		return nil, fmt.Errorf("packet too big to be fragmented")
+	}
+
+	fragments := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * fragmentSize
+		if end > len(packetBytes) {
+			end = len(packetBytes)
+		}
+
+		fragment := &Fragment{ID: id, Index: uint32(i), Count: uint32(count), Data: packetBytes[i*fragmentSize : end]}
+		fragmentBytes, err := protobuf.Encode(&GossipPacket{Fragment: fragment})
+		if err != nil {
+			return nil, err
+		}
+		fragments = append(fragments, fragmentBytes)
+	}
+
+	return fragments, nil
+}
+
+// add fragment from the peer, it returns the whole encoded packet once all the fragments arrived.
+// Each peer can have at most maxPendingFragmentSets packets and maxFrameSize bytes pending, all the peers together maxPendingFragmentBytes
+func (fragmentHandler *FragmentHandler) addFragment(fragment *Fragment, address *net.UDPAddr) []byte {
+
+	if fragment.Count == 0 || fragment.Count > uint32(maxFragments) || fragment.Index >= fragment.Count {
+		return nil
+	}
+
+	fragmentHandler.mutex.Lock()
+	defer fragmentHandler.mutex.Unlock()
+
+	key := fragmentKey{address: address.String(), id: fragment.ID}
+
+	peer, loaded := fragmentHandler.peers[key.address]
+	if !loaded {
+		peer = &peerFragments{}
+		fragmentHandler.peers[key.address] = peer
+	}
+
+	set, loaded := fragmentHandler.fragmentSets[key]
+	if !loaded {
+		// too many packets of the peer being reassembled, drop it
+		if peer.sets >= maxPendingFragmentSets {
+			fragmentHandler.removePeerIfEmpty(key.address)
+			return nil
+		}
+		set = &fragmentSet{fragments: make([][]byte, fragment.Count), firstSeen: time.Now()}
+		fragmentHandler.fragmentSets[key] = set
+		peer.sets++
+	}
+
+	// drop fragments not consistent with the ones already received
+	if uint32(len(set.fragments)) != fragment.Count || set.fragments[fragment.Index] != nil {
+		return nil
+	}
+
+	// no room for the fragment, the whole packet is dropped
+	if peer.size+len(fragment.Data) > maxFrameSize || fragmentHandler.size+len(fragment.Data) > maxPendingFragmentBytes {
+		fragmentHandler.removeFragmentSet(key, set)
+		return nil
+	}
+
+	set.fragments[fragment.Index] = fragment.Data
+	set.received++
+	set.size += len(fragment.Data)
+	peer.size += len(fragment.Data)
+	fragmentHandler.size += len(fragment.Data)
+
+	if set.received < len(set.fragments) {
+		return nil
+	}
+
+	fragmentHandler.removeFragmentSet(key, set)
+
+	packetBytes := make([]byte, 0)
+	for _, data := range set.fragments {
+		packetBytes = append(packetBytes, data...)
+	}
+	return packetBytes
+}
+
+// remove fragment set and its bytes from the counters, without locking
+func (fragmentHandler *FragmentHandler) removeFragmentSet(key fragmentKey, set *fragmentSet) {
+	delete(fragmentHandler.fragmentSets, key)
+	fragmentHandler.size -= set.size
+
+	if peer, loaded := fragmentHandler.peers[key.address]; loaded {
+		peer.sets--
+		peer.size -= set.size
+		fragmentHandler.removePeerIfEmpty(key.address)
+	}
+}
+
+// forget the counters of the peer if it has no pending packets, without locking
+func (fragmentHandler *FragmentHandler) removePeerIfEmpty(address string) {
+	if peer, loaded := fragmentHandler.peers[address]; loaded && peer.sets == 0 {
+		delete(fragmentHandler.peers, address)
+	}
+}
+
+// remove fragment sets not completed in time
+func (fragmentHandler *FragmentHandler) removeIncompleteFragmentSets() {
+	fragmentHandler.mutex.Lock()
+	defer fragmentHandler.mutex.Unlock()
+
+	for key, set := range fragmentHandler.fragmentSets {
+		if time.Since(set.firstSeen) > fragmentTimeout {
+			fragmentHandler.removeFragmentSet(key, set)
+
+			if debug {
+				fmt.Println("Incomplete packet discarded")
+			}
+		}
+	}
+}
+
+// periodically discard incomplete fragment sets
+func (gossiper *Gossiper) startFragmentsCleanup() {
+	timer := time.NewTicker(fragmentTimeout)
+	for {
+		select {
+		case <-timer.C:
+			gossiper.ConnectionHandler.fragmentHandler.removeIncompleteFragmentSets()
+		}
+	}
+}
+
+// write encoded packet to the address with udp, in fragments if it doesn't fit in the mtu
+func (connectionHandler *ConnectionHandler) writePacket(packetBytes []byte, address *net.UDPAddr) {
+	maxSize := mtu
+	if connectionHandler.secureChannel != nil {
+		maxSize -= sealedOverhead
+	}
+
+	if len(packetBytes) <= maxSize {
+		err := connectionHandler.sendFrame(packetBytes, address, false)
+		helpers.ErrorCheck(err, false)
+		return
+	}
+
+	fragments, err := createFragments(packetBytes, maxSize)
+	helpers.ErrorCheck(err, false)
+	if err != nil {
+		return
+	}
+
+	for _, fragment := range fragments {
+		err = connectionHandler.sendFrame(fragment, address, false)
+		helpers.ErrorCheck(err, false)
+	}
+}
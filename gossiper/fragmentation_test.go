@@ -0,0 +1,113 @@
+package gossiper
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// add the fragment from the peer to the handler and check the packet returned, nil if not complete
+func checkFragment(t *testing.T, fragmentHandler *FragmentHandler, address string, fragment *Fragment, expected []byte) {
+	udpAddress, err := net.ResolveUDPAddr("udp4", address)
+	if err != nil {
+		t.Fatalf("failed when resolving address: %s", err)
+	}
+
+	packet := fragmentHandler.addFragment(fragment, udpAddress)
+	if !bytes.Equal(packet, expected) || (packet == nil) != (expected == nil) {
+		t.Fatalf("failed when adding fragment %d/%d of packet %d from %s: got packet of %d bytes, expected %d bytes", fragment.Index, fragment.Count, fragment.ID, address, len(packet), len(expected))
+	}
+}
+
+func TestFragmentReassembly(t *testing.T) {
+
+	peerA := "10.0.0.1:5000"
+	peerB := "10.0.0.2:5000"
+
+	// fragments in order
+	fragmentHandler := NewFragmentHandler()
+	checkFragment(t, fragmentHandler, peerA, &Fragment{ID: 1, Index: 0, Count: 2, Data: []byte("hello ")}, nil)
+	checkFragment(t, fragmentHandler, peerA, &Fragment{ID: 1, Index: 1, Count: 2, Data: []byte("world")}, []byte("hello world"))
+
+	// fragments out of order
+	checkFragment(t, fragmentHandler, peerA, &Fragment{ID: 2, Index: 2, Count: 3, Data: []byte("c")}, nil)
+	checkFragment(t, fragmentHandler, peerA, &Fragment{ID: 2, Index: 0, Count: 3, Data: []byte("a")}, nil)
+	checkFragment(t, fragmentHandler, peerA, &Fragment{ID: 2, Index: 1, Count: 3, Data: []byte("b")}, []byte("abc"))
+
+	// invalid count or index
+	checkFragment(t, fragmentHandler, peerA, &Fragment{ID: 3, Index: 0, Count: 0}, nil)
+	checkFragment(t, fragmentHandler, peerA, &Fragment{ID: 3, Index: 2, Count: 2}, nil)
+	checkFragment(t, fragmentHandler, peerA, &Fragment{ID: 3, Index: 0, Count: 4097}, nil)
+
+	// duplicate and inconsistent fragments are ignored
+	checkFragment(t, fragmentHandler, peerA, &Fragment{ID: 4, Index: 0, Count: 2, Data: []byte("a")}, nil)
+	checkFragment(t, fragmentHandler, peerA, &Fragment{ID: 4, Index: 0, Count: 2, Data: []byte("x")}, nil)
+	checkFragment(t, fragmentHandler, peerA, &Fragment{ID: 4, Index: 1, Count: 3, Data: []byte("x")}, nil)
+	checkFragment(t, fragmentHandler, peerA, &Fragment{ID: 4, Index: 1, Count: 2, Data: []byte("b")}, []byte("ab"))
+
+	// the same id from different peers belongs to different packets
+	checkFragment(t, fragmentHandler, peerA, &Fragment{ID: 5, Index: 0, Count: 2, Data: []byte("a")}, nil)
+	checkFragment(t, fragmentHandler, peerB, &Fragment{ID: 5, Index: 1, Count: 2, Data: []byte("x")}, nil)
+	checkFragment(t, fragmentHandler, peerA, &Fragment{ID: 5, Index: 1, Count: 2, Data: []byte("b")}, []byte("ab"))
+	checkFragment(t, fragmentHandler, peerB, &Fragment{ID: 5, Index: 0, Count: 2, Data: []byte("y")}, []byte("yx"))
+}
+
+func TestFragmentLimits(t *testing.T) {
+
+	peerA := "10.0.0.1:5000"
+	peerB := "10.0.0.2:5000"
+
+	// fill the pending packets of a peer, one fragment each out of two
+	fragmentHandler := NewFragmentHandler()
+	for id := uint64(0); id < uint64(maxPendingFragmentSets); id++ {
+		checkFragment(t, fragmentHandler, peerA, &Fragment{ID: id, Index: 0, Count: 2, Data: []byte("a")}, nil)
+	}
+
+	// a new packet of the peer is dropped, the other peers are not affected
+	checkFragment(t, fragmentHandler, peerA, &Fragment{ID: 100, Index: 0, Count: 1, Data: []byte("x")}, nil)
+	checkFragment(t, fragmentHandler, peerB, &Fragment{ID: 100, Index: 0, Count: 1, Data: []byte("y")}, []byte("y"))
+
+	// once a packet completes there's room again
+	checkFragment(t, fragmentHandler, peerA, &Fragment{ID: 0, Index: 1, Count: 2, Data: []byte("b")}, []byte("ab"))
+	checkFragment(t, fragmentHandler, peerA, &Fragment{ID: 100, Index: 0, Count: 1, Data: []byte("x")}, []byte("x"))
+
+	// a packet that doesn't fit in the bytes left for the peer is dropped
+	fragmentHandler = NewFragmentHandler()
+	big := make([]byte, 10*1024*1024)
+	medium := make([]byte, 7*1024*1024)
+	checkFragment(t, fragmentHandler, peerA, &Fragment{ID: 1, Index: 0, Count: 2, Data: big}, nil)
+	checkFragment(t, fragmentHandler, peerA, &Fragment{ID: 2, Index: 0, Count: 2, Data: medium}, nil)
+	checkFragment(t, fragmentHandler, peerA, &Fragment{ID: 2, Index: 1, Count: 2, Data: []byte("b")}, nil)
+
+	// the same packet from another peer fits
+	checkFragment(t, fragmentHandler, peerB, &Fragment{ID: 2, Index: 0, Count: 2, Data: medium}, nil)
+	checkFragment(t, fragmentHandler, peerB, &Fragment{ID: 2, Index: 1, Count: 2, Data: []byte("b")}, append(append([]byte{}, medium...), 'b'))
+}
+
+func TestIncompleteFragmentsEviction(t *testing.T) {
+
+	fragmentHandler := NewFragmentHandler()
+	peer := "10.0.0.1:5000"
+
+	checkFragment(t, fragmentHandler, peer, &Fragment{ID: 1, Index: 0, Count: 2, Data: []byte("a")}, nil)
+
+	// nothing is discarded before the timeout
+	fragmentHandler.removeIncompleteFragmentSets()
+	if len(fragmentHandler.fragmentSets) != 1 {
+		t.Fatalf("failed when removing incomplete fragments: set discarded before timeout")
+	}
+
+	// fragment timeout
+	for _, set := range fragmentHandler.fragmentSets {
+		set.firstSeen = time.Now().Add(-2 * fragmentTimeout)
+	}
+	fragmentHandler.removeIncompleteFragmentSets()
+	if len(fragmentHandler.fragmentSets) != 0 || len(fragmentHandler.peers) != 0 || fragmentHandler.size != 0 {
+		t.Fatalf("failed when removing incomplete fragments: set not discarded after timeout")
+	}
+
+	// the set was discarded, so the fragment starts a new one
+	checkFragment(t, fragmentHandler, peer, &Fragment{ID: 1, Index: 1, Count: 2, Data: []byte("b")}, nil)
+	checkFragment(t, fragmentHandler, peer, &Fragment{ID: 1, Index: 0, Count: 2, Data: []byte("a")}, []byte("ab"))
+}
@@ -25,10 +25,14 @@ type Gossiper struct {
 
 	// handle connection with peers and client
 	ConnectionHandler *ConnectionHandler
+	// sign my messages and verify the origin of the others
+	identityHandler *IdentityHandler
 	// handle gossip messages and status messages
 	gossipHandler *GossipHandler
 	// handle routing table and forwarding
 	routingHandler *RoutingHandler
+	// handle peer exchange with other nodes
+	discoveryHandler *DiscoveryHandler
 	// handle file indexing, sharing and searching
 	fileHandler *FileHandler
 	// handle abstractions for the blockchain (gossip with confirmation, tlc and qsc)
@@ -46,12 +50,19 @@ func NewGossiper(name, gossiperAddress, clientAddress, peers string, peersNum ui
 		PeersData: createPeersData(peers, peersNum),
 
 		ConnectionHandler: NewConnectionHandler(gossiperAddress, clientAddress),
+		identityHandler:   NewIdentityHandler(name),
 		gossipHandler:     NewGossipHandler(),
 		routingHandler:    NewRoutingHandler(),
+		discoveryHandler:  NewDiscoveryHandler(),
 		fileHandler:       NewFileHandler(),
 		blockchainHandler: NewBlockchainHandler(),
 	}
 
+	// bootstrap nodes are the first peers
+	for _, peer := range gossiper.discoveryHandler.bootstrapPeers {
+		gossiper.AddPeer(peer)
+	}
+
 	return gossiper
 
 }
@@ -129,6 +140,7 @@ func (gossiper *Gossiper) Run() {
 	go gossiper.startAntiEntropy()
 
 	go gossiper.startRouteRumormongering()
+	go gossiper.startRouteExpiration()
 	go gossiper.processPrivateMessages()
 
 	go gossiper.processDataRequest()
@@ -143,9 +155,18 @@ func (gossiper *Gossiper) Run() {
 
 	go gossiper.processClientBlocks()
 
+	if !simpleMode {
+		go gossiper.processPeerExchange()
+		go gossiper.startPeerDiscovery()
+		go gossiper.startPeerLivenessCheck()
+		go gossiper.processKeyRotations()
+		go gossiper.startKeyRotationAnnouncement()
+	}
+
 	// listen for incoming packets
 	go gossiper.receivePacketsFromClient(clientChannel)
 	go gossiper.receivePacketsFromPeers()
+	go gossiper.startFragmentsCleanup()
 
 	if debug {
 		fmt.Println("Gossiper running")
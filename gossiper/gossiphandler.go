@@ -43,12 +43,14 @@ func (gossiper *Gossiper) HandleGossipMessage(extPacket *ExtendedGossipPacket, o
 
 	if origin != gossiper.Name {
 
-		// update routing table
+		// update routing table, the message is stored with my distance from the origin
 		textMessage := ""
 		if packetType == "rumor" {
 			textMessage = extPacket.Packet.Rumor.Text
 		}
-		gossiper.routingHandler.updateRoutingTable(origin, textMessage, id, extPacket.SenderAddr)
+		packet, hops := incrementHops(extPacket.Packet)
+		extPacket = &ExtendedGossipPacket{Packet: packet, SenderAddr: extPacket.SenderAddr}
+		gossiper.routingHandler.updateRoutingTable(origin, textMessage, id, hops, extPacket.SenderAddr)
 
 		// store message
 		isMessageKnown = gossiper.gossipHandler.storeMessage(extPacket.Packet, origin, id)
@@ -73,12 +75,37 @@ func (gossiper *Gossiper) HandleGossipMessage(extPacket *ExtendedGossipPacket, o
 	}
 }
 
+// copy the packet with the hops of the gossip message incremented, returning the new value.
+// The received packet is not modified, other goroutines may be reading it
+func incrementHops(packet *GossipPacket) (*GossipPacket, uint32) {
+	packetCopy := *packet
+	switch {
+	case packet.Rumor != nil:
+		rumor := *packet.Rumor
+		rumor.Hops++
+		packetCopy.Rumor = &rumor
+		return &packetCopy, rumor.Hops
+	case packet.TLCMessage != nil:
+		tlcMessage := *packet.TLCMessage
+		tlcMessage.Hops++
+		packetCopy.TLCMessage = &tlcMessage
+		return &packetCopy, tlcMessage.Hops
+	case packet.WhisperStatus != nil:
+		whisperStatus := *packet.WhisperStatus
+		whisperStatus.Hops++
+		packetCopy.WhisperStatus = &whisperStatus
+		return &packetCopy, whisperStatus.Hops
+	}
+	return &packetCopy, 1
+}
+
 // create new rumor message
 func (gossiper *Gossiper) CreateRumorMessage(text string) *ExtendedGossipPacket {
 	id := atomic.LoadUint32(&gossiper.gossipHandler.seqID)
 	atomic.AddUint32(&gossiper.gossipHandler.seqID, uint32(1))
 	rumorPacket := &RumorMessage{Origin: gossiper.Name, ID: id, Text: text}
 	extPacket := &ExtendedGossipPacket{Packet: &GossipPacket{Rumor: rumorPacket}, SenderAddr: gossiper.ConnectionHandler.GossiperData.Address}
+	gossiper.identityHandler.signPacket(extPacket.Packet)
 	gossiper.gossipHandler.storeMessage(extPacket.Packet, gossiper.Name, id)
 
 	if text != "" {
@@ -113,6 +140,7 @@ func (gossiper *Gossiper) SendWhisperStatus(status *WhisperStatus) {
 	status.ID = id
 
 	packet := &GossipPacket{WhisperStatus: status}
+	gossiper.identityHandler.signPacket(packet)
 
 	// store message
 	gossiper.gossipHandler.storeMessage(packet, gossiper.Name, id)
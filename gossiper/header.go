@@ -1,6 +1,7 @@
 package gossiper
 
 import (
+	"crypto/ed25519"
 	"time"
 )
 
@@ -16,7 +17,7 @@ var hw3ex3Mode = false
 var hw3ex4Mode = false
 var ackAllMode = false
 
-var modeTypes = []string{"simple", "rumor", "status", "private", "dataRequest", "dataReply", "searchRequest", "searchReply", "tlcMes", "tlcAck", "clientBlock", "tlcCausal", "whisperPacket", "whisperStatus"}
+var modeTypes = []string{"simple", "rumor", "status", "private", "dataRequest", "dataReply", "searchRequest", "searchReply", "tlcMes", "tlcAck", "clientBlock", "tlcCausal", "whisperPacket", "whisperStatus", "peerExchange", "heartbeat", "keyRotation"}
 
 // channels used throughout the app to exchange messages
 var PacketChannels map[string]chan *ExtendedGossipPacket
@@ -26,6 +27,59 @@ var PacketChannels map[string]chan *ExtendedGossipPacket
 var maxBufferSize = 60000
 var maxChannelSize = 1024
 
+// fragmentation of packets bigger than the mtu, pending packets are limited per peer (maxFrameSize bytes at most) and in total
+var mtu = 60000
+var minMTU = 512
+var maxDatagramSize = 65507
+var maxFragments = 4096
+var maxPendingFragmentSets = 16
+var maxPendingFragmentBytes = 128 * 1024 * 1024
+var fragmentTimeout = 5 * time.Second
+
+// transport used with peers and tcp settings
+var transportMode = "udp"
+var tcpDialTimeout = 2 * time.Second
+var tcpRedialTimeout = 5 * time.Second
+var frameLengthSize = 4
+var maxFrameSize = 16 * 1024 * 1024
+
+// secure links with peers, disabled if there's no key
+var linkPrivateKey []byte
+var allowedLinkKeys map[string]bool
+var handshakeTimeout = 5 * time.Second
+var maxQueuedFrames = 64
+var maxSeenEphemeralKeys = 4096
+
+// peer discovery, disabled if the target is 0
+var targetPeers = 0
+var bootstrapPeers []string
+var discoveryTimeout = 10 * time.Second
+var discoveryFanout = 3
+var maxExchangedPeers = 20
+
+// peer set limits, no limit if 0
+var maxPeers = 32
+var staticPeers []string
+
+// unknown peers probed at the same time, they're added only if they answer
+var maxProbedPeers = 256
+
+// peer liveness, eviction disabled if the timeout is 0
+var peerTimeout = 60 * time.Second
+var heartbeatTimeout = 5 * time.Second
+var suspectTimeout = 3 * heartbeatTimeout
+
+// routes not refreshed within the timeout expire, expiration disabled if 0
+var routeTimeout = 5 * time.Minute
+
+// long-term key of the node, a new one is generated if not loaded
+var identityPrivateKey ed25519.PrivateKey
+
+// key replaced by the current one, the rotation is announced to the peers a few times
+var previousIdentityKey ed25519.PrivateKey
+var rotationTimeout = 10 * time.Second
+var rotationAnnouncements = 30
+
 // timeouts in seconds if not specified
 var rumorTimeout = 1
 var stubbornTimeout = 10
@@ -68,6 +122,10 @@ type GossipPacket struct {
 	Ack           *TLCAck
 	WhisperPacket *WhisperPacket
 	WhisperStatus *WhisperStatus
+	Fragment      *Fragment
+	PeerExchange  *PeerExchange
+	Heartbeat     *Heartbeat
+	KeyRotation   *KeyRotation
 }
 
 // RumorMessage struct
@@ -75,6 +133,11 @@ type RumorMessage struct {
 	Origin string
 	ID     uint32
 	Text   string
+	// hops travelled from the origin, incremented by each node
+	Hops uint32
+	// key of the origin and its signature
+	PublicKey []byte
+	Signature []byte
 }
 
 // StatusPacket struct
@@ -95,6 +158,9 @@ type PrivateMessage struct {
 	Text        string
 	Destination string
 	HopLimit    uint32
+	// key of the origin and its signature
+	PublicKey []byte
+	Signature []byte
 }
 
 // DataRequest struct
@@ -103,6 +169,9 @@ type DataRequest struct {
 	Destination string
 	HopLimit    uint32
 	HashValue   []byte
+	// key of the origin and its signature
+	PublicKey []byte
+	Signature []byte
 }
 
 // DataReply struct
@@ -112,6 +181,9 @@ type DataReply struct {
 	HopLimit    uint32
 	HashValue   []byte
 	Data        []byte
+	// key of the origin and its signature
+	PublicKey []byte
+	Signature []byte
 }
 
 // SearchRequest struct
@@ -119,6 +191,9 @@ type SearchRequest struct {
 	Origin   string
 	Budget   uint64
 	Keywords []string
+	// key of the origin and its signature
+	PublicKey []byte
+	Signature []byte
 }
 
 // SearchReply struct
@@ -127,6 +202,9 @@ type SearchReply struct {
 	Destination string
 	HopLimit    uint32
 	Results     []*SearchResult
+	// key of the origin and its signature
+	PublicKey []byte
+	Signature []byte
 }
 
 // SearchResult struct
@@ -158,6 +236,11 @@ type TLCMessage struct {
 	TxBlock     BlockPublish
 	VectorClock *StatusPacket
 	Fitness     float32
+	// hops travelled from the origin, incremented by each node
+	Hops uint32
+	// key of the origin and its signature
+	PublicKey []byte
+	Signature []byte
 }
 
 // TLCAck type
@@ -170,6 +253,20 @@ type WhisperPacket struct {
 	Payload []byte
 }
 
+// Fragment struct, part of an encoded packet bigger than the mtu
+type Fragment struct {
+	ID    uint64
+	Index uint32
+	Count uint32
+	Data  []byte
+}
+
+// PeerExchange struct, request for the peers known by a node or reply with them
+type PeerExchange struct {
+	Request bool
+	Peers   []string
+}
+
 // WhisperStatus struct
 type WhisperStatus struct {
 	Origin string
@@ -177,4 +274,14 @@ type WhisperStatus struct {
 	Code   uint32
 	Bloom  []byte
 	Pow    float64
+	// maximum envelope size accepted, 0 if not advertised
+	MaxMsgSize uint32
+	// exact topics of interest, only valid if TopicInterest is set
+	Topics        [][]byte
+	TopicInterest bool
+	// hops travelled from the origin, incremented by each node
+	Hops uint32
+	// key of the origin and its signature
+	PublicKey []byte
+	Signature []byte
 }
@@ -0,0 +1,321 @@
+package gossiper
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/dedis/protobuf"
+	"github.com/mikanikos/Peerster/helpers"
+)
+
+// KeyRotation struct, binds the name of the origin to a new key, signed with both the old key and the new one
+type KeyRotation struct {
+	Origin       string
+	OldKey       []byte
+	NewKey       []byte
+	OldSignature []byte
+	NewSignature []byte
+}
+
+// IdentityHandler struct: long-term key of the node and keys bound to the names of the other nodes
+type IdentityHandler struct {
+	privateKey ed25519.PrivateKey
+	publicKey  ed25519.PublicKey
+	// name -> public key, bound with the first valid signed message from that name and changed only by a key rotation signed with the bound key
+	keys  map[string]ed25519.PublicKey
+	mutex sync.RWMutex
+	// rotation of the key of the node, nil if the key was not rotated
+	rotation *KeyRotation
+}
+
+// LoadIdentity loads the long-term key of the node from the file, creating it if it doesn't exist.
+// The key must be kept across runs: peers reject a name signed with a different key until they restart, unless the key is rotated
+func LoadIdentity(keyFile string) error {
+	seed, err := loadKey(keyFile)
+	if err != nil {
+		return err
+	}
+	identityPrivateKey = ed25519.NewKeyFromSeed(seed)
+	return nil
+}
+
+// DefaultIdentityFile returns the file of the long-term key of the node in the config folder of the user, so that the same key is used wherever the node is started from
+func DefaultIdentityFile(name string) (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	identityDir := filepath.Join(configDir, "Peerster")
+	err = os.MkdirAll(identityDir, 0700)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(identityDir, name+".identity"), nil
+}
+
+// RotateIdentity replaces the long-term key in the file with a new one, the peers are told to bind the name to the new key with a message signed by the old one
+func RotateIdentity(keyFile string) error {
+	// there's nothing to rotate if the key doesn't exist yet
+	_, err := os.Stat(keyFile)
+	if err != nil {
+		return err
+	}
+	seed, err := loadKey(keyFile)
+	if err != nil {
+		return err
+	}
+
+	newSeed, err := generateKey()
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first, so that the old key is not lost if writing fails
+	err = ioutil.WriteFile(keyFile+".tmp", []byte(hex.EncodeToString(newSeed)), 0600)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(keyFile+".tmp", keyFile)
+	if err != nil {
+		return err
+	}
+
+	previousIdentityKey = ed25519.NewKeyFromSeed(seed)
+	identityPrivateKey = ed25519.NewKeyFromSeed(newSeed)
+	return nil
+}
+
+// NewIdentityHandler create new identity handler, with a new key if none was loaded, and binds the name to it
+func NewIdentityHandler(name string) *IdentityHandler {
+	privateKey := identityPrivateKey
+	if privateKey == nil {
+		var err error
+		_, privateKey, err = ed25519.GenerateKey(nil)
+		helpers.ErrorCheck(err, true)
+	}
+	publicKey := privateKey.Public().(ed25519.PublicKey)
+
+	identityHandler := &IdentityHandler{
+		privateKey: privateKey,
+		publicKey:  publicKey,
+		keys:       map[string]ed25519.PublicKey{name: publicKey},
+	}
+
+	if previousIdentityKey != nil {
+		identityHandler.rotation = createKeyRotation(name, previousIdentityKey, privateKey)
+	}
+
+	return identityHandler
+}
+
+// create key rotation from the old key to the new one, signed with both
+func createKeyRotation(name string, oldKey, newKey ed25519.PrivateKey) *KeyRotation {
+	rotation := &KeyRotation{Origin: name, OldKey: oldKey.Public().(ed25519.PublicKey), NewKey: newKey.Public().(ed25519.PublicKey)}
+
+	data, err := protobuf.Encode(rotation)
+	helpers.ErrorCheck(err, true)
+
+	rotation.OldSignature = ed25519.Sign(oldKey, data)
+	rotation.NewSignature = ed25519.Sign(newKey, data)
+	return rotation
+}
+
+// get origin, content covered by the signature and signature fields of the message in the packet, nil content if the packet has no origin
+// the content is wrapped in a packet so that messages of different types are never confused, fields changed by relays (hop limit, hops, budget) are not signed
+func getSignedFields(packet *GossipPacket) (string, interface{}, *[]byte, *[]byte) {
+	switch {
+	case packet.Rumor != nil:
+		content := *packet.Rumor
+		content.Hops, content.PublicKey, content.Signature = 0, nil, nil
+		return packet.Rumor.Origin, &GossipPacket{Rumor: &content}, &packet.Rumor.PublicKey, &packet.Rumor.Signature
+
+	case packet.Private != nil:
+		content := *packet.Private
+		content.HopLimit, content.PublicKey, content.Signature = 0, nil, nil
+		return packet.Private.Origin, &GossipPacket{Private: &content}, &packet.Private.PublicKey, &packet.Private.Signature
+
+	case packet.Ack != nil:
+		content := *packet.Ack
+		content.HopLimit, content.PublicKey, content.Signature = 0, nil, nil
+		return packet.Ack.Origin, &GossipPacket{Ack: &content}, &packet.Ack.PublicKey, &packet.Ack.Signature
+
+	case packet.TLCMessage != nil:
+		content := *packet.TLCMessage
+		content.Hops, content.PublicKey, content.Signature = 0, nil, nil
+		return packet.TLCMessage.Origin, &GossipPacket{TLCMessage: &content}, &packet.TLCMessage.PublicKey, &packet.TLCMessage.Signature
+
+	case packet.DataRequest != nil:
+		content := *packet.DataRequest
+		content.HopLimit, content.PublicKey, content.Signature = 0, nil, nil
+		return packet.DataRequest.Origin, &GossipPacket{DataRequest: &content}, &packet.DataRequest.PublicKey, &packet.DataRequest.Signature
+
+	case packet.DataReply != nil:
+		content := *packet.DataReply
+		content.HopLimit, content.PublicKey, content.Signature = 0, nil, nil
+		return packet.DataReply.Origin, &GossipPacket{DataReply: &content}, &packet.DataReply.PublicKey, &packet.DataReply.Signature
+
+	case packet.SearchRequest != nil:
+		content := *packet.SearchRequest
+		content.Budget, content.PublicKey, content.Signature = 0, nil, nil
+		return packet.SearchRequest.Origin, &GossipPacket{SearchRequest: &content}, &packet.SearchRequest.PublicKey, &packet.SearchRequest.Signature
+
+	case packet.SearchReply != nil:
+		content := *packet.SearchReply
+		content.HopLimit, content.PublicKey, content.Signature = 0, nil, nil
+		return packet.SearchReply.Origin, &GossipPacket{SearchReply: &content}, &packet.SearchReply.PublicKey, &packet.SearchReply.Signature
+
+	case packet.WhisperStatus != nil:
+		content := *packet.WhisperStatus
+		content.Hops, content.PublicKey, content.Signature = 0, nil, nil
+		return packet.WhisperStatus.Origin, &GossipPacket{WhisperStatus: &content}, &packet.WhisperStatus.PublicKey, &packet.WhisperStatus.Signature
+	}
+
+	return "", nil, nil, nil
+}
+
+// signPacket signs the message in the packet with the key of the node
+func (identityHandler *IdentityHandler) signPacket(packet *GossipPacket) {
+	_, content, publicKey, signature := getSignedFields(packet)
+	if content == nil {
+		return
+	}
+
+	data, err := protobuf.Encode(content)
+	helpers.ErrorCheck(err, false)
+	if err != nil {
+		return
+	}
+
+	*publicKey = identityHandler.publicKey
+	*signature = ed25519.Sign(identityHandler.privateKey, data)
+}
+
+// verifyPacket checks that the message in the packet was signed by its origin with the key bound to its name, packets without origin are always valid
+func (identityHandler *IdentityHandler) verifyPacket(packet *GossipPacket) bool {
+	origin, content, publicKey, signature := getSignedFields(packet)
+	if content == nil {
+		return true
+	}
+
+	if len(*publicKey) != ed25519.PublicKeySize || len(*signature) != ed25519.SignatureSize {
+		return false
+	}
+
+	data, err := protobuf.Encode(content)
+	if err != nil || !ed25519.Verify(*publicKey, data, *signature) {
+		return false
+	}
+
+	return identityHandler.bindKey(origin, *publicKey)
+}
+
+// bind the key to the name if it's the first one seen, otherwise check it's the same
+func (identityHandler *IdentityHandler) bindKey(name string, publicKey ed25519.PublicKey) bool {
+	identityHandler.mutex.Lock()
+	defer identityHandler.mutex.Unlock()
+
+	boundKey, loaded := identityHandler.keys[name]
+	if !loaded {
+		identityHandler.keys[name] = append(ed25519.PublicKey{}, publicKey...)
+		return true
+	}
+	return bytes.Equal(boundKey, publicKey)
+}
+
+// rotateKey binds the name to the new key if the rotation is signed with both keys and the old key is the one bound, false if nothing changed.
+// Rotations for names not bound yet are rejected: anyone can sign one, so it would let an attacker bind the name before its owner is ever seen
+func (identityHandler *IdentityHandler) rotateKey(rotation *KeyRotation) bool {
+	if len(rotation.OldKey) != ed25519.PublicKeySize || len(rotation.NewKey) != ed25519.PublicKeySize ||
+		len(rotation.OldSignature) != ed25519.SignatureSize || len(rotation.NewSignature) != ed25519.SignatureSize {
+		return false
+	}
+
+	content := *rotation
+	content.OldSignature, content.NewSignature = nil, nil
+	data, err := protobuf.Encode(&content)
+	if err != nil || !ed25519.Verify(rotation.OldKey, data, rotation.OldSignature) || !ed25519.Verify(rotation.NewKey, data, rotation.NewSignature) {
+		return false
+	}
+
+	identityHandler.mutex.Lock()
+	defer identityHandler.mutex.Unlock()
+
+	boundKey, loaded := identityHandler.keys[rotation.Origin]
+	if !loaded || !bytes.Equal(boundKey, rotation.OldKey) {
+		return false
+	}
+	identityHandler.keys[rotation.Origin] = append(ed25519.PublicKey{}, rotation.NewKey...)
+	return true
+}
+
+// process key rotations: bind the name to the new key and forward the rotation to the other peers if it changed the binding
+func (gossiper *Gossiper) processKeyRotations() {
+	for extPacket := range PacketChannels["keyRotation"] {
+		if !gossiper.identityHandler.rotateKey(extPacket.Packet.KeyRotation) {
+			continue
+		}
+
+		if debug {
+			fmt.Println("Key of " + extPacket.Packet.KeyRotation.Origin + " rotated")
+		}
+
+		for _, peer := range gossiper.GetPeers() {
+			if peer.String() != extPacket.SenderAddr.String() {
+				go gossiper.ConnectionHandler.SendPacket(extPacket.Packet, peer)
+			}
+		}
+	}
+}
+
+// announce the rotation of the key of the node to the peers a few times, so that also the peers added later get it
+func (gossiper *Gossiper) startKeyRotationAnnouncement() {
+	rotation := gossiper.identityHandler.rotation
+	if rotation == nil {
+		return
+	}
+
+	timer := time.NewTicker(rotationTimeout)
+	defer timer.Stop()
+	for i := 0; i < rotationAnnouncements; i++ {
+		for _, peer := range gossiper.GetPeers() {
+			go gossiper.ConnectionHandler.SendPacket(&GossipPacket{KeyRotation: rotation}, peer)
+		}
+		<-timer.C
+	}
+}
+
+// GetIdentityKey returns the hex public key of the node
+func (gossiper *Gossiper) GetIdentityKey() string {
+	return hex.EncodeToString(gossiper.identityHandler.publicKey)
+}
+
+// GetIdentities returns the hex public keys bound to the names of the nodes
+func (gossiper *Gossiper) GetIdentities() map[string]string {
+	gossiper.identityHandler.mutex.RLock()
+	defer gossiper.identityHandler.mutex.RUnlock()
+
+	identities := make(map[string]string, len(gossiper.identityHandler.keys))
+	for name, key := range gossiper.identityHandler.keys {
+		identities[name] = hex.EncodeToString(key)
+	}
+	return identities
+}
+
+// drop packets whose origin is not authentic
+func (gossiper *Gossiper) isAuthentic(packet *GossipPacket) bool {
+	if gossiper.identityHandler.verifyPacket(packet) {
+		return true
+	}
+
+	if debug {
+		fmt.Println("Dropped packet with invalid signature")
+	}
+	return false
+}
@@ -0,0 +1,149 @@
+package gossiper
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// Heartbeat struct, probe sent to peers not heard from for a while
+type Heartbeat struct {
+	Reply bool
+}
+
+// SetPeerTimeout sets the seconds after which a peer that doesn't answer is evicted, 0 disables eviction
+func SetPeerTimeout(seconds uint) {
+	peerTimeout = time.Duration(seconds) * time.Second
+}
+
+// SubscribePeerRemoval returns a channel where evicted peers are sent, so that their state can be cleaned up
+func (gossiper *Gossiper) SubscribePeerRemoval() chan *net.UDPAddr {
+	gossiper.PeersData.Mutex.Lock()
+	defer gossiper.PeersData.Mutex.Unlock()
+
+	listener := make(chan *net.UDPAddr, maxChannelSize)
+	gossiper.PeersData.removalListeners = append(gossiper.PeersData.removalListeners, listener)
+	return listener
+}
+
+// GetSuspectedPeers returns the peers not heard from for a while, not evicted yet
+func (gossiper *Gossiper) GetSuspectedPeers() []*net.UDPAddr {
+	gossiper.PeersData.Mutex.RLock()
+	defer gossiper.PeersData.Mutex.RUnlock()
+
+	return gossiper.PeersData.getSuspectedUnsafe()
+}
+
+// check if the peer is known and not suspected
+func (gossiper *Gossiper) isResponsivePeer(peer *net.UDPAddr) bool {
+	gossiper.PeersData.Mutex.RLock()
+	defer gossiper.PeersData.Mutex.RUnlock()
+
+	_, known := gossiper.PeersData.Info[peer.String()]
+	_, suspected := gossiper.PeersData.Suspected[peer.String()]
+	return known && !suspected
+}
+
+// periodically probe silent peers, demote the ones that don't answer and then evict them
+func (gossiper *Gossiper) startPeerLivenessCheck() {
+	if peerTimeout <= 0 {
+		return
+	}
+
+	timer := time.NewTicker(heartbeatTimeout)
+	for {
+		select {
+		case <-timer.C:
+			toProbe, evicted := gossiper.PeersData.updatePeersLiveness()
+
+			for _, peer := range toProbe {
+				gossiper.ConnectionHandler.SendPacket(&GossipPacket{Heartbeat: &Heartbeat{}}, peer)
+			}
+
+			for _, peer := range evicted {
+				gossiper.removePeer(peer)
+			}
+		}
+	}
+}
+
+// check when each peer was last seen: it returns the peers to probe and the ones evicted, static peers are never evicted
+func (peersData *PeersData) updatePeersLiveness() ([]*net.UDPAddr, []*net.UDPAddr) {
+	peersData.Mutex.Lock()
+	defer peersData.Mutex.Unlock()
+
+	toProbe := make([]*net.UDPAddr, 0)
+	evicted := make([]*net.UDPAddr, 0)
+
+	active := make([]*net.UDPAddr, 0, len(peersData.Peers))
+	for _, peer := range peersData.Peers {
+		info := peersData.Info[peer.String()]
+		silence := time.Since(info.LastSeen)
+
+		switch {
+		case silence > peerTimeout && !info.Static:
+			evicted = append(evicted, peer)
+		case silence > suspectTimeout:
+			peersData.Suspected[peer.String()] = peer
+			toProbe = append(toProbe, peer)
+
+			if debug {
+				fmt.Println("Peer " + peer.String() + " suspected")
+			}
+		default:
+			if silence > heartbeatTimeout {
+				toProbe = append(toProbe, peer)
+			}
+			active = append(active, peer)
+		}
+	}
+	peersData.Peers = active
+
+	for key, peer := range peersData.Suspected {
+		info := peersData.Info[key]
+		if time.Since(info.LastSeen) > peerTimeout && !info.Static {
+			delete(peersData.Suspected, key)
+			evicted = append(evicted, peer)
+		} else if !containsAddress(toProbe, peer) {
+			toProbe = append(toProbe, peer)
+		}
+	}
+
+	for _, peer := range evicted {
+		delete(peersData.Info, peer.String())
+	}
+
+	return toProbe, evicted
+}
+
+// check if the address is in the list
+func containsAddress(addresses []*net.UDPAddr, address *net.UDPAddr) bool {
+	for _, a := range addresses {
+		if a.String() == address.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// clean up the state kept for the evicted peer and notify the listeners
+func (gossiper *Gossiper) removePeer(peer *net.UDPAddr) {
+	if debug {
+		fmt.Println("Peer " + peer.String() + " evicted")
+	}
+
+	gossiper.routingHandler.removeRoutesThrough(peer)
+	gossiper.gossipHandler.mongeringChannels.Delete(peer.String())
+	gossiper.ConnectionHandler.removePeer(peer)
+
+	gossiper.PeersData.Mutex.RLock()
+	defer gossiper.PeersData.Mutex.RUnlock()
+
+	for _, listener := range gossiper.PeersData.removalListeners {
+		// don't block if the listener is slow
+		select {
+		case listener <- peer:
+		default:
+		}
+	}
+}
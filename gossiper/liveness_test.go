@@ -0,0 +1,64 @@
+package gossiper
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// create peers data with a single peer silent for the given time
+func newLivenessPeersData(peer *net.UDPAddr, silence time.Duration, static, suspected bool) *PeersData {
+	peersData := &PeersData{
+		Peers:     make([]*net.UDPAddr, 0),
+		Info:      map[string]*PeerInfo{peer.String(): {Static: static, Since: time.Now().Add(-time.Hour), LastSeen: time.Now().Add(-silence)}},
+		Suspected: make(map[string]*net.UDPAddr),
+	}
+	if suspected {
+		peersData.Suspected[peer.String()] = peer
+	} else {
+		peersData.Peers = append(peersData.Peers, peer)
+	}
+	return peersData
+}
+
+// update the liveness of the peer and check its state afterwards
+func checkLiveness(t *testing.T, peersData *PeersData, peer *net.UDPAddr, expectedActive, expectedSuspected, expectedEvicted, expectedProbed bool) {
+	toProbe, evicted := peersData.updatePeersLiveness()
+
+	active := containsAddress(peersData.Peers, peer)
+	_, suspected := peersData.Suspected[peer.String()]
+	_, known := peersData.Info[peer.String()]
+
+	if active != expectedActive || suspected != expectedSuspected || containsAddress(evicted, peer) != expectedEvicted || known == expectedEvicted {
+		t.Fatalf("failed when updating liveness: got active %v, suspected %v, evicted %v and known %v", active, suspected, containsAddress(evicted, peer), known)
+	}
+	if containsAddress(toProbe, peer) != expectedProbed {
+		t.Fatalf("failed when updating liveness: got probed %v, expected %v", containsAddress(toProbe, peer), expectedProbed)
+	}
+}
+
+func TestPeersLiveness(t *testing.T) {
+
+	peer, err := net.ResolveUDPAddr("udp4", "10.0.0.1:5000")
+	if err != nil {
+		t.Fatalf("failed when resolving address: %s", err)
+	}
+
+	// just heard, nothing to do
+	checkLiveness(t, newLivenessPeersData(peer, 0, false, false), peer, true, false, false, false)
+
+	// silent for a heartbeat, still active but probed
+	checkLiveness(t, newLivenessPeersData(peer, heartbeatTimeout+time.Second, false, false), peer, true, false, false, true)
+
+	// silent for long, suspected and probed
+	checkLiveness(t, newLivenessPeersData(peer, suspectTimeout+time.Second, false, false), peer, false, true, false, true)
+
+	// dead, evicted unless it's static
+	checkLiveness(t, newLivenessPeersData(peer, peerTimeout+time.Second, false, false), peer, false, false, true, false)
+	checkLiveness(t, newLivenessPeersData(peer, peerTimeout+time.Second, true, false), peer, false, true, false, true)
+
+	// suspected peers are probed until they are dead
+	checkLiveness(t, newLivenessPeersData(peer, suspectTimeout+time.Second, false, true), peer, false, true, false, true)
+	checkLiveness(t, newLivenessPeersData(peer, peerTimeout+time.Second, false, true), peer, false, false, true, false)
+	checkLiveness(t, newLivenessPeersData(peer, peerTimeout+time.Second, true, true), peer, false, true, false, true)
+}
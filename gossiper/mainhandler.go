@@ -61,6 +61,7 @@ func (gossiper *Gossiper) processSearchRequest() {
 					}
 					searchReply := &SearchReply{Origin: gossiper.Name, Destination: extPacket.Packet.SearchRequest.Origin, HopLimit: uint32(hopLimit), Results: searchResults}
 					packetToSend := &GossipPacket{SearchReply: searchReply}
+					gossiper.identityHandler.signPacket(packetToSend)
 
 					go gossiper.forwardPrivateMessage(packetToSend, &packetToSend.SearchReply.HopLimit, packetToSend.SearchReply.Destination)
 				}
@@ -121,6 +122,8 @@ func (gossiper *Gossiper) processDataRequest() {
 				}
 			}
 
+			gossiper.identityHandler.signPacket(packetToSend)
+
 			// send data found (or nil) to peer who requested
 			go gossiper.forwardPrivateMessage(packetToSend, &packetToSend.DataReply.HopLimit, packetToSend.DataReply.Destination)
 
@@ -172,8 +175,14 @@ func (gossiper *Gossiper) processDataReply() {
 func (gossiper *Gossiper) processPrivateMessages() {
 	for extPacket := range PacketChannels["private"] {
 
-		// update routing table
-		gossiper.routingHandler.updateRoutingTable(extPacket.Packet.Private.Destination, extPacket.Packet.Private.Text, extPacket.Packet.Private.ID, extPacket.SenderAddr)
+		// learn a route towards the origin only if there's none, the hops are estimated assuming the origin uses my hop limit
+		if extPacket.Packet.Private.Origin != gossiper.Name {
+			privateHops := uint32(1)
+			if extPacket.Packet.Private.HopLimit < uint32(hopLimit) {
+				privateHops = uint32(hopLimit) - extPacket.Packet.Private.HopLimit
+			}
+			gossiper.routingHandler.addMissingRoute(extPacket.Packet.Private.Origin, privateHops, extPacket.SenderAddr)
+		}
 
 		// if for me, handle private message
 		if extPacket.Packet.Private.Destination == gossiper.Name {
@@ -220,6 +229,7 @@ func (gossiper *Gossiper) processClientMessages(clientChannel chan *helpers.Mess
 			// create private message and forward it
 			privatePacket := &PrivateMessage{Origin: gossiper.Name, ID: 0, Text: message.Text, Destination: *message.Destination, HopLimit: uint32(hopLimit)}
 			packet.Packet = &GossipPacket{Private: privatePacket}
+			gossiper.identityHandler.signPacket(packet.Packet)
 
 			go func(p *PrivateMessage) {
 				gossiper.gossipHandler.latestRumors <- &RumorMessage{Text: p.Text, Origin: p.Origin}
@@ -249,6 +259,7 @@ func (gossiper *Gossiper) processClientMessages(clientChannel chan *helpers.Mess
 
 			requestPacket := &SearchRequest{Origin: gossiper.Name, Keywords: keywordsSplitted, Budget: *message.Budget}
 			packet.Packet = &GossipPacket{SearchRequest: requestPacket}
+			gossiper.identityHandler.signPacket(packet.Packet)
 
 			// if 0, means bufget was not specified: so use default budget and increment after timeout
 			needIncrement := (*message.Budget == 0)
@@ -1,16 +1,59 @@
 package gossiper
 
 import (
+	"fmt"
 	"net"
 	"strings"
 	"sync"
+	"time"
 )
 
+// PeerInfo struct: how and when a peer was added and last heard from
+type PeerInfo struct {
+	// the peer contacted me first, otherwise I chose it
+	Inbound bool
+	// pinned peer, never dropped
+	Static bool
+	// time the peer was added
+	Since time.Time
+	// time of the last packet received from it (or of when it was added)
+	LastSeen time.Time
+}
+
 // PeersData struct
 type PeersData struct {
 	Peers []*net.UDPAddr
 	Size  uint64
-	Mutex sync.RWMutex
+	// peer -> info, for both active and suspected peers
+	Info map[string]*PeerInfo
+	// peers not heard from for a while: they only get heartbeats until they answer or are evicted
+	Suspected map[string]*net.UDPAddr
+	// unknown peers that contacted me -> time they were probed, they're added only if they answer the heartbeat
+	Probed map[string]time.Time
+	// notified when a peer is evicted
+	removalListeners []chan *net.UDPAddr
+	// score of a peer given by other subsystems, negative if it misbehaved
+	scorer func(peer string) float64
+	Mutex  sync.RWMutex
+}
+
+// SetPeerLimits sets the maximum number of peers (0 for no limit), half of the slots are for the peers I choose and half for the ones contacting me,
+// static peers (comma separated ip:port) don't take any slot and are never dropped
+func SetPeerLimits(max uint, static string) error {
+	peers := make([]string, 0)
+	if static != "" {
+		for _, peer := range strings.Split(static, ",") {
+			_, err := net.ResolveUDPAddr("udp4", peer)
+			if err != nil {
+				return fmt.Errorf("invalid static peer %s", peer)
+			}
+			peers = append(peers, peer)
+		}
+	}
+
+	maxPeers = int(max)
+	staticPeers = peers
+	return nil
 }
 
 // create PeersData
@@ -22,36 +65,284 @@ func createPeersData(peers string, size uint64) *PeersData {
 		peersList = strings.Split(peers, ",")
 	}
 
-	// resolve peers addresses given
-	peersAddresses := make([]*net.UDPAddr, 0)
-	for _, peer := range peersList {
+	peersData := &PeersData{Peers: make([]*net.UDPAddr, 0), Size: size, Info: make(map[string]*PeerInfo), Suspected: make(map[string]*net.UDPAddr), Probed: make(map[string]time.Time)}
+
+	// resolve peers addresses given, static ones first so that they're not added twice
+	for i, peer := range append(append([]string{}, staticPeers...), peersList...) {
 		addressPeer, err := net.ResolveUDPAddr("udp4", peer)
 		if err == nil {
-			peersAddresses = append(peersAddresses, addressPeer)
+			peersData.addPeer(addressPeer, false, i < len(staticPeers))
 		}
 	}
 
-	return &PeersData{Peers: peersAddresses, Size: size}
+	return peersData
 }
 
-// AddPeer to peers list if not present
-func (gossiper *Gossiper) AddPeer(peer *net.UDPAddr) {
+// number of slots for the peers of the given direction, 0 if no limit
+func peerSlots(inbound bool) int {
+	outboundSlots := (maxPeers + 1) / 2
+	if inbound {
+		return maxPeers - outboundSlots
+	}
+	return outboundSlots
+}
 
-	if peer.String() == gossiper.ConnectionHandler.GossiperData.Address.String() {
+// add peer without checking the slots
+func (peersData *PeersData) addPeer(peer *net.UDPAddr, inbound, static bool) {
+	if _, loaded := peersData.Info[peer.String()]; loaded {
 		return
 	}
 
-	gossiper.PeersData.Mutex.Lock()
-	defer gossiper.PeersData.Mutex.Unlock()
-	contains := false
-	for _, p := range gossiper.PeersData.Peers {
+	now := time.Now()
+	peersData.Info[peer.String()] = &PeerInfo{Inbound: inbound, Static: static, Since: now, LastSeen: now}
+	peersData.Peers = append(peersData.Peers, peer)
+}
+
+// remove peer, both if active or suspected
+func (peersData *PeersData) deletePeer(peer *net.UDPAddr) {
+	delete(peersData.Info, peer.String())
+	delete(peersData.Suspected, peer.String())
+
+	for i, p := range peersData.Peers {
 		if p.String() == peer.String() {
-			contains = true
+			peersData.Peers = append(peersData.Peers[:i], peersData.Peers[i+1:]...)
 			break
 		}
 	}
-	if !contains {
-		gossiper.PeersData.Peers = append(gossiper.PeersData.Peers, peer)
+}
+
+// admit the new peer if there's a slot for it, making room if some peer is worth less and eviction is allowed: it returns if it was added and the peer evicted for it, if any
+func (peersData *PeersData) admitPeer(peer *net.UDPAddr, inbound, evict bool) (bool, *net.UDPAddr) {
+	slots := peerSlots(inbound)
+
+	used := 0
+	for _, info := range peersData.Info {
+		if info.Inbound == inbound && !info.Static {
+			used++
+		}
+	}
+
+	if maxPeers == 0 || used < slots {
+		peersData.addPeer(peer, inbound, false)
+		return true, nil
+	}
+
+	if !evict {
+		return false, nil
+	}
+
+	evicted := peersData.selectPeerToEvict(peer, inbound)
+	if evicted == nil {
+		return false, nil
+	}
+
+	peersData.deletePeer(evicted)
+	peersData.addPeer(peer, inbound, false)
+	return true, evicted
+}
+
+// select the peer to make room for the new one, nil if all the peers are worth keeping:
+// suspected peers first, then peers in the most crowded subnet if the new peer makes the set more diverse, then peers that misbehaved;
+// among them the lowest scored and the most recent, so that long-lived peers are kept
+func (peersData *PeersData) selectPeerToEvict(newcomer *net.UDPAddr, inbound bool) *net.UDPAddr {
+	candidates := make([]*net.UDPAddr, 0)
+	subnets := make(map[string]int)
+
+	for _, peer := range append(peersData.getSuspectedUnsafe(), peersData.Peers...) {
+		info := peersData.Info[peer.String()]
+		if info.Inbound == inbound && !info.Static {
+			candidates = append(candidates, peer)
+			subnets[getSubnet(peer)]++
+		}
+	}
+
+	// suspected peers are probably gone
+	var worst *net.UDPAddr
+	for _, peer := range candidates {
+		if _, suspected := peersData.Suspected[peer.String()]; suspected {
+			if worst == nil || peersData.Info[peer.String()].LastSeen.Before(peersData.Info[worst.String()].LastSeen) {
+				worst = peer
+			}
+		}
+	}
+	if worst != nil {
+		return worst
+	}
+
+	// peers in the most crowded subnet, if the new one comes from a less crowded subnet
+	crowdedSubnet := ""
+	for subnet, count := range subnets {
+		if count > subnets[crowdedSubnet] {
+			crowdedSubnet = subnet
+		}
+	}
+	if subnets[crowdedSubnet] > 1 && subnets[getSubnet(newcomer)]+1 < subnets[crowdedSubnet] {
+		return peersData.selectWorstPeer(candidates, func(peer *net.UDPAddr) bool {
+			return getSubnet(peer) == crowdedSubnet
+		})
+	}
+
+	// peers that misbehaved
+	return peersData.selectWorstPeer(candidates, func(peer *net.UDPAddr) bool {
+		return peersData.getScore(peer) < 0
+	})
+}
+
+// get lowest scored peer among the ones filtered, the most recent if same score
+func (peersData *PeersData) selectWorstPeer(candidates []*net.UDPAddr, filter func(*net.UDPAddr) bool) *net.UDPAddr {
+	var worst *net.UDPAddr
+	worstScore := 0.0
+
+	for _, peer := range candidates {
+		if !filter(peer) {
+			continue
+		}
+
+		score := peersData.getScore(peer)
+		if worst == nil || score < worstScore || (score == worstScore && peersData.Info[peer.String()].Since.After(peersData.Info[worst.String()].Since)) {
+			worst = peer
+			worstScore = score
+		}
+	}
+	return worst
+}
+
+// get score of the peer, 0 if no subsystem gives scores
+func (peersData *PeersData) getScore(peer *net.UDPAddr) float64 {
+	if peersData.scorer == nil {
+		return 0
+	}
+	return peersData.scorer(peer.String())
+}
+
+// get suspected peers, without locking
+func (peersData *PeersData) getSuspectedUnsafe() []*net.UDPAddr {
+	peers := make([]*net.UDPAddr, 0, len(peersData.Suspected))
+	for _, peer := range peersData.Suspected {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// subnet of the address, /24 for ipv4 and /64 for ipv6
+func getSubnet(address *net.UDPAddr) string {
+	if ip := address.IP.To4(); ip != nil {
+		return ip.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return address.IP.Mask(net.CIDRMask(64, 128)).String()
+}
+
+// SetPeerScorer sets the function giving the score of a peer (negative if it misbehaved), used to choose which peers to drop
+func (gossiper *Gossiper) SetPeerScorer(scorer func(peer string) float64) {
+	gossiper.PeersData.Mutex.Lock()
+	defer gossiper.PeersData.Mutex.Unlock()
+
+	gossiper.PeersData.scorer = scorer
+}
+
+// AddPeer chosen by the user if there's an outbound slot for it
+func (gossiper *Gossiper) AddPeer(peer *net.UDPAddr) {
+	gossiper.addPeerWithDirection(peer, false, true)
+}
+
+// mark the peer who sent a valid packet as alive: an unknown peer is probed first and it's added, if there's an inbound slot for it, only when it answers,
+// so that peers are never added or evicted for packets with a spoofed address
+func (gossiper *Gossiper) markPeerAlive(peer *net.UDPAddr, packet *GossipPacket) {
+	if peer.String() == gossiper.ConnectionHandler.GossiperData.Address.String() || gossiper.PeersData.refreshPeer(peer) {
+		return
+	}
+
+	// no heartbeats in simple mode, the peer is added only if there's a free slot
+	if simpleMode {
+		gossiper.addPeerWithDirection(peer, true, false)
+		return
+	}
+
+	if packet.Heartbeat != nil && packet.Heartbeat.Reply && gossiper.PeersData.isProbed(peer) {
+		gossiper.addPeerWithDirection(peer, true, true)
+		return
+	}
+
+	if gossiper.PeersData.markProbed(peer) {
+		go gossiper.ConnectionHandler.SendPacket(&GossipPacket{Heartbeat: &Heartbeat{}}, peer)
+	}
+}
+
+// refresh the last time the peer was seen, false if it's not known
+func (peersData *PeersData) refreshPeer(peer *net.UDPAddr) bool {
+	peersData.Mutex.Lock()
+	defer peersData.Mutex.Unlock()
+
+	info, loaded := peersData.Info[peer.String()]
+	if !loaded {
+		return false
+	}
+	info.LastSeen = time.Now()
+
+	// suspected peer is back
+	if _, suspected := peersData.Suspected[peer.String()]; suspected {
+		delete(peersData.Suspected, peer.String())
+		peersData.Peers = append(peersData.Peers, peer)
+
+		if debug {
+			fmt.Println("Peer " + peer.String() + " is alive again")
+		}
+	}
+	return true
+}
+
+// remember that the unknown peer was probed, false if it was probed recently or there are too many peers probed
+func (peersData *PeersData) markProbed(peer *net.UDPAddr) bool {
+	peersData.Mutex.Lock()
+	defer peersData.Mutex.Unlock()
+
+	for key, probeTime := range peersData.Probed {
+		if time.Since(probeTime) >= heartbeatTimeout {
+			delete(peersData.Probed, key)
+		}
+	}
+
+	if _, loaded := peersData.Probed[peer.String()]; loaded || len(peersData.Probed) >= maxProbedPeers {
+		return false
+	}
+	peersData.Probed[peer.String()] = time.Now()
+	return true
+}
+
+// check if the peer was probed recently, so that its heartbeat is an answer
+func (peersData *PeersData) isProbed(peer *net.UDPAddr) bool {
+	peersData.Mutex.Lock()
+	defer peersData.Mutex.Unlock()
+
+	probeTime, loaded := peersData.Probed[peer.String()]
+	delete(peersData.Probed, peer.String())
+	return loaded && time.Since(probeTime) < heartbeatTimeout
+}
+
+// add peer to peers list if not present, the peer is considered alive
+func (gossiper *Gossiper) addPeerWithDirection(peer *net.UDPAddr, inbound, evict bool) {
+
+	if peer.String() == gossiper.ConnectionHandler.GossiperData.Address.String() || gossiper.PeersData.refreshPeer(peer) {
+		return
+	}
+
+	gossiper.PeersData.Mutex.Lock()
+
+	// added in the meantime
+	if _, loaded := gossiper.PeersData.Info[peer.String()]; loaded {
+		gossiper.PeersData.Mutex.Unlock()
+		return
+	}
+
+	added, evicted := gossiper.PeersData.admitPeer(peer, inbound, evict)
+	gossiper.PeersData.Mutex.Unlock()
+
+	if !added && debug {
+		fmt.Println("No slot for peer " + peer.String())
+	}
+
+	if evicted != nil {
+		gossiper.removePeer(evicted)
 	}
 }
 
@@ -67,6 +358,15 @@ func (gossiper *Gossiper) GetPeerFromString(addr string) *net.UDPAddr {
 	return nil
 }
 
+// check if the peer is known, even if suspected
+func (gossiper *Gossiper) isKnownPeer(peer *net.UDPAddr) bool {
+	gossiper.PeersData.Mutex.RLock()
+	defer gossiper.PeersData.Mutex.RUnlock()
+
+	_, loaded := gossiper.PeersData.Info[peer.String()]
+	return loaded
+}
+
 // GetPeers in concurrent environment
 func (gossiper *Gossiper) GetPeers() []*net.UDPAddr {
 	gossiper.PeersData.Mutex.RLock()
@@ -0,0 +1,114 @@
+package gossiper
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// create empty peers data, the score of the peers is taken from the map
+func newEvictionPeersData(scores map[string]float64) *PeersData {
+	return &PeersData{
+		Peers:     make([]*net.UDPAddr, 0),
+		Info:      make(map[string]*PeerInfo),
+		Suspected: make(map[string]*net.UDPAddr),
+		scorer: func(peer string) float64 {
+			return scores[peer]
+		},
+	}
+}
+
+// add inbound peer added minutes ago and last seen seconds ago
+func addEvictionPeer(peersData *PeersData, address string, minutes, seconds int, suspected bool) *PeerInfo {
+	peer, _ := net.ResolveUDPAddr("udp4", address)
+	info := &PeerInfo{
+		Inbound:  true,
+		Since:    time.Now().Add(-time.Duration(minutes) * time.Minute),
+		LastSeen: time.Now().Add(-time.Duration(seconds) * time.Second),
+	}
+	peersData.Info[peer.String()] = info
+	if suspected {
+		peersData.Suspected[peer.String()] = peer
+	} else {
+		peersData.Peers = append(peersData.Peers, peer)
+	}
+	return info
+}
+
+// select the peer to evict for the inbound newcomer and check it's the expected one, empty if none
+func checkEviction(t *testing.T, peersData *PeersData, newcomer, expected string) {
+	address, _ := net.ResolveUDPAddr("udp4", newcomer)
+	evicted := peersData.selectPeerToEvict(address, true)
+	if (evicted == nil && expected != "") || (evicted != nil && evicted.String() != expected) {
+		t.Fatalf("failed when selecting peer to evict for %s: got %v, expected %q", newcomer, evicted, expected)
+	}
+}
+
+func TestSelectPeerToEvict(t *testing.T) {
+
+	// no peer of the same direction
+	scores := map[string]float64{"10.0.1.1:1": -10}
+	peersData := newEvictionPeersData(scores)
+	addEvictionPeer(peersData, "10.0.1.1:1", 0, 0, true).Inbound = false
+	checkEviction(t, peersData, "10.0.2.1:1", "")
+
+	// static peers are kept
+	peersData = newEvictionPeersData(scores)
+	addEvictionPeer(peersData, "10.0.1.1:1", 0, 0, true).Static = true
+	checkEviction(t, peersData, "10.0.2.1:1", "")
+
+	// suspected peers go first, the one silent for longer
+	scores = map[string]float64{"10.0.3.1:1": -10}
+	peersData = newEvictionPeersData(scores)
+	addEvictionPeer(peersData, "10.0.1.1:1", 0, 20, true)
+	addEvictionPeer(peersData, "10.0.2.1:1", 0, 40, true)
+	addEvictionPeer(peersData, "10.0.3.1:1", 0, 0, false)
+	checkEviction(t, peersData, "10.0.4.1:1", "10.0.2.1:1")
+
+	// then the most recent peer of the crowded subnet
+	scores = map[string]float64{}
+	peersData = newEvictionPeersData(scores)
+	addEvictionPeer(peersData, "10.0.1.1:1", 30, 0, false)
+	addEvictionPeer(peersData, "10.0.1.2:1", 10, 0, false)
+	addEvictionPeer(peersData, "10.0.1.3:1", 20, 0, false)
+	addEvictionPeer(peersData, "10.0.2.1:1", 5, 0, false)
+	checkEviction(t, peersData, "10.0.3.1:1", "10.0.1.2:1")
+
+	// unless a peer of the subnet has a lower score
+	scores = map[string]float64{"10.0.1.1:1": -1}
+	peersData = newEvictionPeersData(scores)
+	addEvictionPeer(peersData, "10.0.1.1:1", 30, 0, false)
+	addEvictionPeer(peersData, "10.0.1.2:1", 10, 0, false)
+	addEvictionPeer(peersData, "10.0.1.3:1", 20, 0, false)
+	checkEviction(t, peersData, "10.0.3.1:1", "10.0.1.1:1")
+
+	// a newcomer from the crowded subnet doesn't get a slot
+	scores = map[string]float64{}
+	peersData = newEvictionPeersData(scores)
+	addEvictionPeer(peersData, "10.0.1.1:1", 30, 0, false)
+	addEvictionPeer(peersData, "10.0.1.2:1", 10, 0, false)
+	addEvictionPeer(peersData, "10.0.2.1:1", 5, 0, false)
+	checkEviction(t, peersData, "10.0.1.3:1", "")
+
+	// then the lowest scored misbehaving peer
+	scores = map[string]float64{"10.0.1.1:1": -5, "10.0.2.1:1": -10}
+	peersData = newEvictionPeersData(scores)
+	addEvictionPeer(peersData, "10.0.1.1:1", 30, 0, false)
+	addEvictionPeer(peersData, "10.0.2.1:1", 10, 0, false)
+	addEvictionPeer(peersData, "10.0.3.1:1", 5, 0, false)
+	checkEviction(t, peersData, "10.0.4.1:1", "10.0.2.1:1")
+
+	// the most recent one if they have the same score
+	scores = map[string]float64{"10.0.1.1:1": -5, "10.0.2.1:1": -5}
+	peersData = newEvictionPeersData(scores)
+	addEvictionPeer(peersData, "10.0.1.1:1", 30, 0, false)
+	addEvictionPeer(peersData, "10.0.2.1:1", 10, 0, false)
+	checkEviction(t, peersData, "10.0.4.1:1", "10.0.2.1:1")
+
+	// all the peers are worth keeping
+	scores = map[string]float64{"10.0.1.1:1": 3}
+	peersData = newEvictionPeersData(scores)
+	addEvictionPeer(peersData, "10.0.1.1:1", 30, 0, false)
+	addEvictionPeer(peersData, "10.0.2.1:1", 10, 0, false)
+	checkEviction(t, peersData, "10.0.4.1:1", "")
+}
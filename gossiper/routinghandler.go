@@ -3,14 +3,44 @@ package gossiper
 import (
 	"fmt"
 	"net"
+	"sort"
 	"sync"
 	"time"
 )
 
+// Route struct: next hop towards an origin, as advertised by the last message from it
+type Route struct {
+	NextHop *net.UDPAddr
+	// number of hops to the origin through the next hop
+	Hops uint32
+	// id of the origin message the route comes from, higher is fresher
+	SeqID uint32
+	// time the route was last refreshed
+	LastUpdate time.Time
+}
+
+// RouteEntry struct: best route to an origin and an alternative through another peer
+type RouteEntry struct {
+	Primary *Route
+	Backup  *Route
+}
+
+// RouteInfo struct: route to an origin as shown to the user, no backup if empty
+type RouteInfo struct {
+	Origin  string
+	NextHop string
+	Hops    uint32
+	SeqID   uint32
+	// seconds since the route was last refreshed
+	Age        float64
+	Backup     string
+	BackupHops uint32
+}
+
 // RoutingHandler struct
 type RoutingHandler struct {
-	// routing table peer->nexthop
-	routingTable map[string]*net.UDPAddr
+	// routing table origin->routes
+	routingTable map[string]*RouteEntry
 	// track current last id (just an optimization in order to not iterate on the message storage every time)
 	originLastID *VectorClock
 	mutex        sync.RWMutex
@@ -19,11 +49,16 @@ type RoutingHandler struct {
 // NewRoutingHandler create new routing handler
 func NewRoutingHandler() *RoutingHandler {
 	return &RoutingHandler{
-		routingTable: make(map[string]*net.UDPAddr),
+		routingTable: make(map[string]*RouteEntry),
 		originLastID: &VectorClock{Entries: make(map[string]uint32)},
 	}
 }
 
+// SetRouteTimeout sets the seconds after which a route that is not refreshed expires, 0 disables expiration
+func SetRouteTimeout(seconds uint) {
+	routeTimeout = time.Duration(seconds) * time.Second
+}
+
 // StartRouteRumormongering with the specified timer
 func (gossiper *Gossiper) startRouteRumormongering() {
 
@@ -51,27 +86,134 @@ func (gossiper *Gossiper) startRouteRumormongering() {
 	}
 }
 
-// update routing table based on packet data
-func (routingHandler *RoutingHandler) updateRoutingTable(origin, textPacket string, idPacket uint32, address *net.UDPAddr) {
+// update routing table based on packet data: fresher routes win, shorter ones if equally fresh, the best route through another peer is kept as backup
+func (routingHandler *RoutingHandler) updateRoutingTable(origin, textPacket string, idPacket, hops uint32, address *net.UDPAddr) {
 
 	routingHandler.mutex.Lock()
 	defer routingHandler.mutex.Unlock()
 
-	// if new packet with higher id, update table
+	// if new packet with higher id, print it
 	if routingHandler.updateLastOriginID(origin, idPacket) {
-
 		if textPacket != "" {
 			if hw2 {
 				fmt.Println("DSDV " + origin + " " + address.String())
 			}
 		}
+	}
 
-		// update
-		routingHandler.routingTable[origin] = address
+	route := &Route{NextHop: address, Hops: hops, SeqID: idPacket, LastUpdate: time.Now()}
 
+	entry, loaded := routingHandler.routingTable[origin]
+	if !loaded {
+		routingHandler.routingTable[origin] = &RouteEntry{Primary: route}
 		if debug {
 			fmt.Println("Routing table updated")
 		}
+		return
+	}
+
+	switch {
+	case route.NextHop.String() == entry.Primary.NextHop.String():
+		// same next hop, only refreshed by newer messages
+		if !isBetterRoute(route, entry.Primary) {
+			return
+		}
+		entry.Primary = route
+
+	case isBetterRoute(route, entry.Primary):
+		// new best next hop, the old one becomes the alternative
+		entry.Backup = entry.Primary
+		entry.Primary = route
+
+	case entry.Backup == nil || isBetterRoute(route, entry.Backup):
+		entry.Backup = route
+
+	default:
+		return
+	}
+
+	if debug {
+		fmt.Println("Routing table updated")
+	}
+}
+
+// add route to the origin only if there's no route to it, used for messages without sequence number that can't replace the routes learnt from rumors
+func (routingHandler *RoutingHandler) addMissingRoute(origin string, hops uint32, address *net.UDPAddr) {
+	routingHandler.mutex.Lock()
+	defer routingHandler.mutex.Unlock()
+
+	if _, loaded := routingHandler.routingTable[origin]; loaded {
+		return
+	}
+
+	routingHandler.routingTable[origin] = &RouteEntry{Primary: &Route{NextHop: address, Hops: hops, LastUpdate: time.Now()}}
+	if debug {
+		fmt.Println("Routing table updated")
+	}
+}
+
+// check if the route is fresher than the other one, or shorter if equally fresh
+func isBetterRoute(route, other *Route) bool {
+	return route.SeqID > other.SeqID || (route.SeqID == other.SeqID && route.Hops < other.Hops)
+}
+
+// remove routes whose next hop is the peer, the backup takes the place of a removed primary
+func (routingHandler *RoutingHandler) removeRoutesThrough(peer *net.UDPAddr) {
+	routingHandler.mutex.Lock()
+	defer routingHandler.mutex.Unlock()
+
+	for origin, entry := range routingHandler.routingTable {
+		if entry.Backup != nil && entry.Backup.NextHop.String() == peer.String() {
+			entry.Backup = nil
+		}
+		if entry.Primary.NextHop.String() == peer.String() {
+			routingHandler.promoteBackup(origin, entry)
+		}
+	}
+}
+
+// remove routes not refreshed within the timeout, the backup takes the place of an expired primary
+func (routingHandler *RoutingHandler) removeExpiredRoutes() {
+	routingHandler.mutex.Lock()
+	defer routingHandler.mutex.Unlock()
+
+	for origin, entry := range routingHandler.routingTable {
+		if entry.Backup != nil && time.Since(entry.Backup.LastUpdate) > routeTimeout {
+			entry.Backup = nil
+		}
+		if time.Since(entry.Primary.LastUpdate) > routeTimeout {
+			routingHandler.promoteBackup(origin, entry)
+		}
+	}
+}
+
+// replace the primary route with the backup, the entry is deleted if there's no backup
+func (routingHandler *RoutingHandler) promoteBackup(origin string, entry *RouteEntry) {
+	if entry.Backup == nil {
+		delete(routingHandler.routingTable, origin)
+		return
+	}
+
+	entry.Primary = entry.Backup
+	entry.Backup = nil
+
+	if debug {
+		fmt.Println("Route to " + origin + " now through " + entry.Primary.NextHop.String())
+	}
+}
+
+// periodically remove the routes that are not refreshed
+func (gossiper *Gossiper) startRouteExpiration() {
+	if routeTimeout <= 0 {
+		return
+	}
+
+	timer := time.NewTicker(routeTimeout / 2)
+	for {
+		select {
+		case <-timer.C:
+			gossiper.routingHandler.removeExpiredRoutes()
+		}
 	}
 }
 
@@ -100,16 +242,36 @@ func (gossiper *Gossiper) forwardPrivateMessage(packet *GossipPacket, hopLimit *
 	if *hopLimit > 0 {
 		*hopLimit = *hopLimit - 1
 
-		// get routing table entry for the origin
-		gossiper.routingHandler.mutex.RLock()
-		addressInTable, isPresent := gossiper.routingHandler.routingTable[destination]
+		// send packet if there's a route
+		addressInTable := gossiper.getNextHop(destination)
+		if addressInTable != nil {
+			gossiper.ConnectionHandler.SendPacket(packet, addressInTable)
+		}
+	}
+}
+
+// get next hop towards the destination: the primary one, or the backup if the primary stopped answering and the backup didn't
+func (gossiper *Gossiper) getNextHop(destination string) *net.UDPAddr {
+	gossiper.routingHandler.mutex.RLock()
+	entry, isPresent := gossiper.routingHandler.routingTable[destination]
+	if !isPresent {
 		gossiper.routingHandler.mutex.RUnlock()
+		return nil
+	}
+	primary := entry.Primary.NextHop
+	var backup *net.UDPAddr
+	if entry.Backup != nil {
+		backup = entry.Backup.NextHop
+	}
+	gossiper.routingHandler.mutex.RUnlock()
 
-		// send packet if address is present
-		if isPresent {
-			gossiper.ConnectionHandler.SendPacket(packet, addressInTable)
+	if backup != nil && !gossiper.isResponsivePeer(primary) && gossiper.isResponsivePeer(backup) {
+		if debug {
+			fmt.Println("Next hop " + primary.String() + " not answering, forwarding through " + backup.String())
 		}
+		return backup
 	}
+	return primary
 }
 
 // GetOrigins in concurrent environment
@@ -125,3 +287,31 @@ func (gossiper *Gossiper) GetOrigins() []string {
 	}
 	return origins
 }
+
+// GetRoutingTable returns the route to every origin, sorted by origin
+func (gossiper *Gossiper) GetRoutingTable() []*RouteInfo {
+	gossiper.routingHandler.mutex.RLock()
+	defer gossiper.routingHandler.mutex.RUnlock()
+
+	routes := make([]*RouteInfo, 0, len(gossiper.routingHandler.routingTable))
+	for origin, entry := range gossiper.routingHandler.routingTable {
+		route := &RouteInfo{
+			Origin:  origin,
+			NextHop: entry.Primary.NextHop.String(),
+			Hops:    entry.Primary.Hops,
+			SeqID:   entry.Primary.SeqID,
+			Age:     time.Since(entry.Primary.LastUpdate).Seconds(),
+		}
+		if entry.Backup != nil {
+			route.Backup = entry.Backup.NextHop.String()
+			route.BackupHops = entry.Backup.Hops
+		}
+		routes = append(routes, route)
+	}
+
+	sort.Slice(routes, func(i, j int) bool {
+		return routes[i].Origin < routes[j].Origin
+	})
+
+	return routes
+}
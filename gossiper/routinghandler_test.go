@@ -0,0 +1,93 @@
+package gossiper
+
+import (
+	"net"
+	"testing"
+)
+
+// update the route to the origin advertised through the next hop
+func updateRoute(routingHandler *RoutingHandler, seqID, hops uint32, nextHop string) {
+	address, _ := net.ResolveUDPAddr("udp4", nextHop)
+	routingHandler.updateRoutingTable("X", "", seqID, hops, address)
+}
+
+// remove the routes through the peer
+func removeRoutes(routingHandler *RoutingHandler, peer string) {
+	address, _ := net.ResolveUDPAddr("udp4", peer)
+	routingHandler.removeRoutesThrough(address)
+}
+
+// check the next hop and the backup of the route to the origin, no route if the next hop is empty
+func checkRoute(t *testing.T, routingHandler *RoutingHandler, nextHop, backup string) {
+	entry, loaded := routingHandler.routingTable["X"]
+	if nextHop == "" {
+		if loaded {
+			t.Fatalf("failed when checking route: route not removed")
+		}
+		return
+	}
+
+	if !loaded || entry.Primary.NextHop.String() != nextHop {
+		t.Fatalf("failed when checking route: expected next hop %s", nextHop)
+	}
+	if (entry.Backup == nil && backup != "") || (entry.Backup != nil && entry.Backup.NextHop.String() != backup) {
+		t.Fatalf("failed when checking route: expected backup %q", backup)
+	}
+}
+
+func TestIsBetterRoute(t *testing.T) {
+
+	// fresher routes win
+	if !isBetterRoute(&Route{SeqID: 2, Hops: 5}, &Route{SeqID: 1, Hops: 1}) {
+		t.Fatalf("failed when comparing fresher route")
+	}
+	if isBetterRoute(&Route{SeqID: 1, Hops: 1}, &Route{SeqID: 2, Hops: 5}) {
+		t.Fatalf("failed when comparing older route")
+	}
+
+	// shorter ones if equally fresh
+	if !isBetterRoute(&Route{SeqID: 1, Hops: 1}, &Route{SeqID: 1, Hops: 2}) {
+		t.Fatalf("failed when comparing shorter route")
+	}
+	if isBetterRoute(&Route{SeqID: 1, Hops: 3}, &Route{SeqID: 1, Hops: 2}) {
+		t.Fatalf("failed when comparing longer route")
+	}
+	if isBetterRoute(&Route{SeqID: 1, Hops: 2}, &Route{SeqID: 1, Hops: 2}) {
+		t.Fatalf("failed when comparing same route")
+	}
+}
+
+func TestRouteBackupPromotion(t *testing.T) {
+
+	// the shorter route becomes primary, the other one backup
+	routingHandler := NewRoutingHandler()
+	updateRoute(routingHandler, 5, 3, "10.0.0.1:1")
+	updateRoute(routingHandler, 5, 1, "10.0.0.2:1")
+	checkRoute(t, routingHandler, "10.0.0.2:1", "10.0.0.1:1")
+
+	// the removal of another peer changes nothing
+	removeRoutes(routingHandler, "10.0.0.3:1")
+	checkRoute(t, routingHandler, "10.0.0.2:1", "10.0.0.1:1")
+
+	// primary removed, backup promoted
+	removeRoutes(routingHandler, "10.0.0.2:1")
+	checkRoute(t, routingHandler, "10.0.0.1:1", "")
+
+	// primary removed without backup
+	removeRoutes(routingHandler, "10.0.0.1:1")
+	checkRoute(t, routingHandler, "", "")
+
+	// backup removed
+	routingHandler = NewRoutingHandler()
+	updateRoute(routingHandler, 5, 1, "10.0.0.1:1")
+	updateRoute(routingHandler, 5, 3, "10.0.0.2:1")
+	checkRoute(t, routingHandler, "10.0.0.1:1", "10.0.0.2:1")
+	removeRoutes(routingHandler, "10.0.0.2:1")
+	checkRoute(t, routingHandler, "10.0.0.1:1", "")
+
+	// both removed
+	updateRoute(routingHandler, 5, 3, "10.0.0.2:1")
+	removeRoutes(routingHandler, "10.0.0.1:1")
+	removeRoutes(routingHandler, "10.0.0.2:1")
+	checkRoute(t, routingHandler, "", "")
+}
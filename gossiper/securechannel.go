@@ -0,0 +1,615 @@
+package gossiper
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// frames exchanged with peers when links are secure
+const (
+	handshakeInitFrame     byte = 1
+	handshakeResponseFrame byte = 2
+	sealedFrame            byte = 3
+)
+
+// handshake frame: type | static key | ephemeral key
+// sealed frame: type | nonce | encrypted packet + tag
+const (
+	linkKeyLength        = curve25519.ScalarSize
+	handshakeFrameLength = 1 + 2*linkKeyLength
+	sealedHeaderLength   = 1 + 8
+	// bytes added to each packet sent on a secure link
+	sealedOverhead = sealedHeaderLength + 16
+	// number of nonces remembered to discard replayed packets
+	replayWindowSize = 64
+)
+
+// replayWindow keeps track of the nonces received recently
+type replayWindow struct {
+	highest uint64
+	// bit i set if highest-i was received
+	seen uint64
+}
+
+// linkSession struct: keys agreed with a peer
+type linkSession struct {
+	// static key of the peer
+	peerKey       []byte
+	sendCipher    cipher.AEAD
+	receiveCipher cipher.AEAD
+	sendNonce     uint64
+	window        replayWindow
+}
+
+// queuedFrame struct: packet waiting for the handshake to complete
+type queuedFrame struct {
+	data []byte
+	tcp  bool
+}
+
+// pendingHandshake struct: handshake started with a peer
+type pendingHandshake struct {
+	ephemeralKey []byte
+	started      time.Time
+	queue        []*queuedFrame
+}
+
+// SecureChannel struct: authenticated and encrypted links with peers
+type SecureChannel struct {
+	privateKey []byte
+	publicKey  []byte
+	// static keys of the peers allowed, any key is accepted if empty
+	allowedKeys map[string]bool
+	// peer address -> session
+	sessions map[string]*linkSession
+	// peer address -> handshake in progress
+	pending map[string]*pendingHandshake
+	// peer address -> session answered but not confirmed by the peer yet, the current one is kept until then
+	confirming map[string]*linkSession
+	// ephemeral keys of the handshakes received, the oldest are forgotten first
+	seenEphemeralKeys map[string]bool
+	seenOrder         []string
+	// write frame to the peer using tcp or udp
+	write func(frame []byte, address *net.UDPAddr, tcp bool) error
+	mutex sync.Mutex
+}
+
+// EnableSecureLinks loads the static key pair of the node from the file, creating it if it doesn't exist, and restricts peers to the allowed keys (comma separated hex, empty to allow any peer)
+func EnableSecureLinks(keyFile, allowedKeys string) error {
+	privateKey, err := loadKey(keyFile)
+	if err != nil {
+		return err
+	}
+
+	allowed := make(map[string]bool)
+	for _, key := range strings.Split(allowedKeys, ",") {
+		key = strings.TrimSpace(strings.ToLower(key))
+		if key == "" {
+			continue
+		}
+		keyBytes, err := hex.DecodeString(key)
+		if err != nil || len(keyBytes) != linkKeyLength {
+			return fmt.Errorf("invalid peer key %s", key)
+		}
+		allowed[key] = true
+	}
+
+	linkPrivateKey = privateKey
+	allowedLinkKeys = allowed
+	return nil
+}
+
+// load hex private key from file, or generate it and save it
+func loadKey(keyFile string) ([]byte, error) {
+	data, err := ioutil.ReadFile(keyFile)
+	if err == nil {
+		privateKey, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(privateKey) != linkKeyLength {
+			return nil, fmt.Errorf("invalid key in %s", keyFile)
+		}
+		return privateKey, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	privateKey, err := generateKey()
+	if err != nil {
+		return nil, err
+	}
+	err = ioutil.WriteFile(keyFile, []byte(hex.EncodeToString(privateKey)), 0600)
+	if err != nil {
+		return nil, err
+	}
+	return privateKey, nil
+}
+
+// generate random private key, used both for x25519 and as ed25519 seed
+func generateKey() ([]byte, error) {
+	privateKey := make([]byte, linkKeyLength)
+	_, err := rand.Read(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	return privateKey, nil
+}
+
+// NewSecureChannel create new secure channel with the static private key
+func NewSecureChannel(privateKey []byte, allowedKeys map[string]bool, write func([]byte, *net.UDPAddr, bool) error) (*SecureChannel, error) {
+	publicKey, err := curve25519.X25519(privateKey, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SecureChannel{
+		privateKey:        privateKey,
+		publicKey:         publicKey,
+		allowedKeys:       allowedKeys,
+		sessions:          make(map[string]*linkSession),
+		pending:           make(map[string]*pendingHandshake),
+		confirming:        make(map[string]*linkSession),
+		seenEphemeralKeys: make(map[string]bool),
+		write:             write,
+	}, nil
+}
+
+// GetPublicKey returns the hex static key of the node
+func (secureChannel *SecureChannel) GetPublicKey() string {
+	return hex.EncodeToString(secureChannel.publicKey)
+}
+
+// GetPeerKey returns the hex static key of the peer, empty if there's no session with it
+func (secureChannel *SecureChannel) GetPeerKey(address *net.UDPAddr) string {
+	secureChannel.mutex.Lock()
+	defer secureChannel.mutex.Unlock()
+
+	session, loaded := secureChannel.sessions[address.String()]
+	if !loaded {
+		return ""
+	}
+	return hex.EncodeToString(session.peerKey)
+}
+
+// forget the session and the handshake with the peer
+func (secureChannel *SecureChannel) removePeer(address *net.UDPAddr) {
+	secureChannel.mutex.Lock()
+	defer secureChannel.mutex.Unlock()
+
+	delete(secureChannel.sessions, address.String())
+	delete(secureChannel.pending, address.String())
+	delete(secureChannel.confirming, address.String())
+}
+
+// remember the ephemeral key of a handshake, false if it was already seen
+func (secureChannel *SecureChannel) markEphemeralKey(ephemeralKey []byte) bool {
+	key := hex.EncodeToString(ephemeralKey)
+	if secureChannel.seenEphemeralKeys[key] {
+		return false
+	}
+
+	if len(secureChannel.seenOrder) >= maxSeenEphemeralKeys {
+		delete(secureChannel.seenEphemeralKeys, secureChannel.seenOrder[0])
+		secureChannel.seenOrder = secureChannel.seenOrder[1:]
+	}
+	secureChannel.seenEphemeralKeys[key] = true
+	secureChannel.seenOrder = append(secureChannel.seenOrder, key)
+	return true
+}
+
+// check if the peer key is in the allowlist
+func (secureChannel *SecureChannel) isAllowed(peerKey []byte) bool {
+	return len(secureChannel.allowedKeys) == 0 || secureChannel.allowedKeys[hex.EncodeToString(peerKey)]
+}
+
+// send encrypts the packet for the peer, it's queued if the handshake is not completed yet
+func (secureChannel *SecureChannel) send(data []byte, address *net.UDPAddr, tcp bool) error {
+	secureChannel.mutex.Lock()
+
+	// use the new session if there's no other one yet
+	session, loaded := secureChannel.sessions[address.String()]
+	if !loaded {
+		session, loaded = secureChannel.confirming[address.String()]
+	}
+	if loaded {
+		frame := session.seal(data)
+		secureChannel.mutex.Unlock()
+		return secureChannel.write(frame, address, tcp)
+	}
+
+	pending, loaded := secureChannel.pending[address.String()]
+	if loaded && time.Since(pending.started) < handshakeTimeout {
+		pending.enqueue(&queuedFrame{data: data, tcp: tcp})
+		secureChannel.mutex.Unlock()
+		return nil
+	}
+
+	// start handshake, or start it again if the peer didn't answer
+	frame, err := secureChannel.startHandshake(address)
+	if err != nil {
+		secureChannel.mutex.Unlock()
+		return err
+	}
+	secureChannel.pending[address.String()].enqueue(&queuedFrame{data: data, tcp: tcp})
+	secureChannel.mutex.Unlock()
+
+	return secureChannel.write(frame, address, tcp)
+}
+
+// start new handshake with the peer, keeping packets already queued
+func (secureChannel *SecureChannel) startHandshake(address *net.UDPAddr) ([]byte, error) {
+	ephemeralKey, err := generateKey()
+	if err != nil {
+		return nil, err
+	}
+	ephemeralPublicKey, err := curve25519.X25519(ephemeralKey, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+
+	pending, loaded := secureChannel.pending[address.String()]
+	if !loaded {
+		pending = &pendingHandshake{}
+		secureChannel.pending[address.String()] = pending
+	}
+	pending.ephemeralKey = ephemeralKey
+	pending.started = time.Now()
+
+	return createHandshakeFrame(handshakeInitFrame, secureChannel.publicKey, ephemeralPublicKey), nil
+}
+
+// open processes a frame from the peer, it returns the packet if the frame carries one
+func (secureChannel *SecureChannel) open(frame []byte, address *net.UDPAddr, tcp bool) []byte {
+	if len(frame) == 0 {
+		return nil
+	}
+
+	switch frame[0] {
+	case handshakeInitFrame:
+		secureChannel.handleHandshakeInit(frame, address, tcp)
+	case handshakeResponseFrame:
+		secureChannel.handleHandshakeResponse(frame, address, tcp)
+	case sealedFrame:
+		return secureChannel.openSealed(frame, address, tcp)
+	}
+	return nil
+}
+
+// answer the handshake started by the peer, the new session replaces the current one only when the peer uses it
+func (secureChannel *SecureChannel) handleHandshakeInit(frame []byte, address *net.UDPAddr, tcp bool) {
+	if len(frame) != handshakeFrameLength {
+		return
+	}
+	peerKey := frame[1 : 1+linkKeyLength]
+	peerEphemeralKey := frame[1+linkKeyLength:]
+
+	secureChannel.mutex.Lock()
+
+	if !secureChannel.isAllowed(peerKey) {
+		secureChannel.mutex.Unlock()
+		if debug {
+			fmt.Println("Handshake from " + address.String() + " rejected, key not allowed")
+		}
+		return
+	}
+
+	// replayed handshake
+	if !secureChannel.markEphemeralKey(peerEphemeralKey) {
+		secureChannel.mutex.Unlock()
+		if debug {
+			fmt.Println("Handshake from " + address.String() + " rejected, replayed")
+		}
+		return
+	}
+
+	// both started the handshake, the one with the lowest key keeps its own
+	pending, loaded := secureChannel.pending[address.String()]
+	if loaded && time.Since(pending.started) < handshakeTimeout && bytes.Compare(secureChannel.publicKey, peerKey) < 0 {
+		secureChannel.mutex.Unlock()
+		return
+	}
+
+	ephemeralKey, err := generateKey()
+	if err != nil {
+		secureChannel.mutex.Unlock()
+		return
+	}
+	ephemeralPublicKey, err := curve25519.X25519(ephemeralKey, curve25519.Basepoint)
+	if err != nil {
+		secureChannel.mutex.Unlock()
+		return
+	}
+
+	session, err := createSession(false, secureChannel.privateKey, ephemeralKey, peerKey, peerEphemeralKey)
+	if err != nil {
+		secureChannel.mutex.Unlock()
+		return
+	}
+	secureChannel.confirming[address.String()] = session
+	delete(secureChannel.pending, address.String())
+
+	response := createHandshakeFrame(handshakeResponseFrame, secureChannel.publicKey, ephemeralPublicKey)
+	frames := secureChannel.sealQueued(session, pending)
+	secureChannel.mutex.Unlock()
+
+	err = secureChannel.write(response, address, tcp)
+	if err != nil {
+		return
+	}
+	secureChannel.writeQueued(frames, address)
+}
+
+// complete the handshake started with the peer
+func (secureChannel *SecureChannel) handleHandshakeResponse(frame []byte, address *net.UDPAddr, tcp bool) {
+	if len(frame) != handshakeFrameLength {
+		return
+	}
+	peerKey := frame[1 : 1+linkKeyLength]
+	peerEphemeralKey := frame[1+linkKeyLength:]
+
+	secureChannel.mutex.Lock()
+
+	pending, loaded := secureChannel.pending[address.String()]
+	if !loaded {
+		secureChannel.mutex.Unlock()
+		return
+	}
+
+	if !secureChannel.isAllowed(peerKey) {
+		delete(secureChannel.pending, address.String())
+		secureChannel.mutex.Unlock()
+		if debug {
+			fmt.Println("Handshake with " + address.String() + " rejected, key not allowed")
+		}
+		return
+	}
+
+	session, err := createSession(true, secureChannel.privateKey, pending.ephemeralKey, peerKey, peerEphemeralKey)
+	if err != nil {
+		secureChannel.mutex.Unlock()
+		return
+	}
+	secureChannel.sessions[address.String()] = session
+	delete(secureChannel.pending, address.String())
+	delete(secureChannel.confirming, address.String())
+
+	// empty packet first to confirm the session to the peer, even if there's nothing queued
+	confirmation := &queuedFrame{data: session.seal(nil), tcp: tcp}
+	frames := append([]*queuedFrame{confirmation}, secureChannel.sealQueued(session, pending)...)
+	secureChannel.mutex.Unlock()
+
+	secureChannel.writeQueued(frames, address)
+}
+
+// decrypt and authenticate packet from the peer, the first packet opened with the new session confirms it
+func (secureChannel *SecureChannel) openSealed(frame []byte, address *net.UDPAddr, tcp bool) []byte {
+	if len(frame) < sealedOverhead {
+		return nil
+	}
+
+	secureChannel.mutex.Lock()
+
+	if session, loaded := secureChannel.confirming[address.String()]; loaded {
+		if data := session.open(frame); data != nil {
+			secureChannel.sessions[address.String()] = session
+			delete(secureChannel.confirming, address.String())
+			secureChannel.mutex.Unlock()
+			return filterEmptyPacket(data)
+		}
+	}
+
+	session, loaded := secureChannel.sessions[address.String()]
+	if !loaded {
+		// the peer has a session I don't know about (e.g. I restarted), start a new one
+		var handshake []byte
+		if pending, loaded := secureChannel.pending[address.String()]; !loaded || time.Since(pending.started) >= handshakeTimeout {
+			handshake, _ = secureChannel.startHandshake(address)
+		}
+		secureChannel.mutex.Unlock()
+
+		if handshake != nil {
+			secureChannel.write(handshake, address, tcp)
+		}
+		return nil
+	}
+	defer secureChannel.mutex.Unlock()
+
+	return filterEmptyPacket(session.open(frame))
+}
+
+// empty packets only confirm the session, there's nothing to process
+func filterEmptyPacket(data []byte) []byte {
+	if len(data) == 0 {
+		return nil
+	}
+	return data
+}
+
+// seal the packets queued during the handshake
+func (secureChannel *SecureChannel) sealQueued(session *linkSession, pending *pendingHandshake) []*queuedFrame {
+	if pending == nil {
+		return nil
+	}
+	frames := make([]*queuedFrame, len(pending.queue))
+	for i, queued := range pending.queue {
+		frames[i] = &queuedFrame{data: session.seal(queued.data), tcp: queued.tcp}
+	}
+	return frames
+}
+
+// write sealed packets to the peer
+func (secureChannel *SecureChannel) writeQueued(frames []*queuedFrame, address *net.UDPAddr) {
+	for _, frame := range frames {
+		secureChannel.write(frame.data, address, frame.tcp)
+	}
+}
+
+// add packet to the queue, dropping the oldest one if full
+func (pending *pendingHandshake) enqueue(frame *queuedFrame) {
+	if len(pending.queue) >= maxQueuedFrames {
+		pending.queue = pending.queue[1:]
+	}
+	pending.queue = append(pending.queue, frame)
+}
+
+// create handshake frame of the given type
+func createHandshakeFrame(frameType byte, staticKey, ephemeralKey []byte) []byte {
+	frame := make([]byte, 0, handshakeFrameLength)
+	frame = append(frame, frameType)
+	frame = append(frame, staticKey...)
+	frame = append(frame, ephemeralKey...)
+	return frame
+}
+
+// derive session keys from the static and ephemeral keys of both sides:
+// ephemeral-ephemeral gives forward secrecy, static-ephemeral proves each side owns its static key
+func createSession(initiator bool, staticKey, ephemeralKey, peerKey, peerEphemeralKey []byte) (*linkSession, error) {
+	ephemeralShared, err := curve25519.X25519(ephemeralKey, peerEphemeralKey)
+	if err != nil {
+		return nil, err
+	}
+	staticShared, err := curve25519.X25519(staticKey, peerEphemeralKey)
+	if err != nil {
+		return nil, err
+	}
+	peerStaticShared, err := curve25519.X25519(ephemeralKey, peerKey)
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey, err := curve25519.X25519(staticKey, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	ephemeralPublicKey, err := curve25519.X25519(ephemeralKey, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+
+	// same order on both sides: initiator first
+	hash := sha256.New()
+	hash.Write([]byte("peerster link"))
+	hash.Write(ephemeralShared)
+	if initiator {
+		hash.Write(staticShared)
+		hash.Write(peerStaticShared)
+		hash.Write(publicKey)
+		hash.Write(peerKey)
+		hash.Write(ephemeralPublicKey)
+		hash.Write(peerEphemeralKey)
+	} else {
+		hash.Write(peerStaticShared)
+		hash.Write(staticShared)
+		hash.Write(peerKey)
+		hash.Write(publicKey)
+		hash.Write(peerEphemeralKey)
+		hash.Write(ephemeralPublicKey)
+	}
+	master := hash.Sum(nil)
+
+	initiatorCipher, err := createLinkCipher(master, "initiator")
+	if err != nil {
+		return nil, err
+	}
+	responderCipher, err := createLinkCipher(master, "responder")
+	if err != nil {
+		return nil, err
+	}
+
+	session := &linkSession{
+		peerKey: append([]byte{}, peerKey...),
+	}
+	if initiator {
+		session.sendCipher, session.receiveCipher = initiatorCipher, responderCipher
+	} else {
+		session.sendCipher, session.receiveCipher = responderCipher, initiatorCipher
+	}
+	return session, nil
+}
+
+// create aes-gcm cipher with the key derived from the master secret for one direction
+func createLinkCipher(master []byte, label string) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, master)
+	mac.Write([]byte(label))
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encrypt packet with the next nonce
+func (session *linkSession) seal(data []byte) []byte {
+	session.sendNonce++
+
+	frame := make([]byte, sealedHeaderLength, sealedHeaderLength+len(data)+session.sendCipher.Overhead())
+	frame[0] = sealedFrame
+	binary.BigEndian.PutUint64(frame[1:], session.sendNonce)
+
+	return session.sendCipher.Seal(frame, createNonce(session.sendNonce), data, frame[:sealedHeaderLength])
+}
+
+// decrypt packet, nil if not authentic or replayed (empty but not nil if authentic and empty)
+func (session *linkSession) open(frame []byte) []byte {
+	nonce := binary.BigEndian.Uint64(frame[1:sealedHeaderLength])
+	if !session.window.isNew(nonce) {
+		return nil
+	}
+
+	data, err := session.receiveCipher.Open([]byte{}, createNonce(nonce), frame[sealedHeaderLength:], frame[:sealedHeaderLength])
+	if err != nil {
+		return nil
+	}
+
+	session.window.mark(nonce)
+	return data
+}
+
+// gcm nonce from the packet counter
+func createNonce(counter uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], counter)
+	return nonce
+}
+
+// check if the nonce was not received yet and is not too old
+func (window *replayWindow) isNew(nonce uint64) bool {
+	if nonce == 0 {
+		return false
+	}
+	if nonce > window.highest {
+		return true
+	}
+	diff := window.highest - nonce
+	return diff < replayWindowSize && window.seen&(1<<diff) == 0
+}
+
+// record the nonce as received
+func (window *replayWindow) mark(nonce uint64) {
+	if nonce > window.highest {
+		shift := nonce - window.highest
+		if shift >= replayWindowSize {
+			window.seen = 0
+		} else {
+			window.seen <<= shift
+		}
+		window.seen |= 1
+		window.highest = nonce
+		return
+	}
+	window.seen |= 1 << (window.highest - nonce)
+}
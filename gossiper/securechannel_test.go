@@ -0,0 +1,61 @@
+package gossiper
+
+import (
+	"testing"
+)
+
+// check if the nonce is accepted by the window as expected, marking it if it is
+func checkNonce(t *testing.T, window *replayWindow, nonce uint64, expected bool) {
+	accepted := window.isNew(nonce)
+	if accepted != expected {
+		t.Fatalf("failed when checking nonce %d: accepted %v, expected %v", nonce, accepted, expected)
+	}
+	if accepted {
+		window.mark(nonce)
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+
+	// zero is never valid
+	window := &replayWindow{}
+	checkNonce(t, window, 0, false)
+	checkNonce(t, window, 1, true)
+	checkNonce(t, window, 0, false)
+
+	// in order, replays are rejected
+	window = &replayWindow{}
+	checkNonce(t, window, 1, true)
+	checkNonce(t, window, 2, true)
+	checkNonce(t, window, 2, false)
+	checkNonce(t, window, 1, false)
+
+	// out of order within the window
+	window = &replayWindow{}
+	checkNonce(t, window, 5, true)
+	checkNonce(t, window, 3, true)
+	checkNonce(t, window, 4, true)
+	checkNonce(t, window, 3, false)
+	checkNonce(t, window, 1, true)
+	checkNonce(t, window, 5, false)
+
+	// the oldest nonce of the window is still accepted, older ones are not
+	window = &replayWindow{}
+	checkNonce(t, window, 64, true)
+	checkNonce(t, window, 1, true)
+	checkNonce(t, window, 1, false)
+
+	window = &replayWindow{}
+	checkNonce(t, window, 65, true)
+	checkNonce(t, window, 1, false)
+	checkNonce(t, window, 2, true)
+
+	// a big jump forgets the window
+	window = &replayWindow{}
+	checkNonce(t, window, 1, true)
+	checkNonce(t, window, 1000, true)
+	checkNonce(t, window, 936, false)
+	checkNonce(t, window, 937, true)
+	checkNonce(t, window, 999, true)
+	checkNonce(t, window, 1000, false)
+}
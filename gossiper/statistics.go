@@ -0,0 +1,82 @@
+package gossiper
+
+import (
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// PeerCounters struct: traffic exchanged with a peer, counted for each datagram or frame on the wire
+type PeerCounters struct {
+	PacketsSent     uint64
+	PacketsReceived uint64
+	BytesSent       uint64
+	BytesReceived   uint64
+}
+
+// PeerStatistics struct: state of a gossip peer and the traffic exchanged with it
+type PeerStatistics struct {
+	Address   string
+	Inbound   bool
+	Static    bool
+	Suspected bool
+	Since     time.Time
+	LastSeen  time.Time
+	PeerCounters
+}
+
+// get the counters of the peer, created if not present
+func (connectionHandler *ConnectionHandler) getCounters(address *net.UDPAddr) *PeerCounters {
+	value, _ := connectionHandler.counters.LoadOrStore(address.String(), &PeerCounters{})
+	return value.(*PeerCounters)
+}
+
+// count packet sent to the peer
+func (connectionHandler *ConnectionHandler) countSent(address *net.UDPAddr, size int) {
+	counters := connectionHandler.getCounters(address)
+	atomic.AddUint64(&counters.PacketsSent, 1)
+	atomic.AddUint64(&counters.BytesSent, uint64(size))
+}
+
+// count packet received from the peer
+func (connectionHandler *ConnectionHandler) countReceived(address *net.UDPAddr, size int) {
+	counters := connectionHandler.getCounters(address)
+	atomic.AddUint64(&counters.PacketsReceived, 1)
+	atomic.AddUint64(&counters.BytesReceived, uint64(size))
+}
+
+// GetPeerStatistics returns every gossip peer, suspected ones included, with its counters, sorted by address
+func (gossiper *Gossiper) GetPeerStatistics() []*PeerStatistics {
+	gossiper.PeersData.Mutex.RLock()
+	defer gossiper.PeersData.Mutex.RUnlock()
+
+	statistics := make([]*PeerStatistics, 0, len(gossiper.PeersData.Info))
+	for peer, info := range gossiper.PeersData.Info {
+		_, suspected := gossiper.PeersData.Suspected[peer]
+		peerStatistics := &PeerStatistics{
+			Address:   peer,
+			Inbound:   info.Inbound,
+			Static:    info.Static,
+			Suspected: suspected,
+			Since:     info.Since,
+			LastSeen:  info.LastSeen,
+		}
+
+		if value, loaded := gossiper.ConnectionHandler.counters.Load(peer); loaded {
+			counters := value.(*PeerCounters)
+			peerStatistics.PacketsSent = atomic.LoadUint64(&counters.PacketsSent)
+			peerStatistics.PacketsReceived = atomic.LoadUint64(&counters.PacketsReceived)
+			peerStatistics.BytesSent = atomic.LoadUint64(&counters.BytesSent)
+			peerStatistics.BytesReceived = atomic.LoadUint64(&counters.BytesReceived)
+		}
+
+		statistics = append(statistics, peerStatistics)
+	}
+
+	sort.Slice(statistics, func(i, j int) bool {
+		return statistics[i].Address < statistics[j].Address
+	})
+
+	return statistics
+}
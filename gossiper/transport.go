@@ -0,0 +1,296 @@
+package gossiper
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mikanikos/Peerster/helpers"
+)
+
+// transports that can be used with peers
+const (
+	udpMode  = "udp"
+	tcpMode  = "tcp"
+	bothMode = "both"
+)
+
+// receivedPacket struct: encoded packet + gossip address of the peer who sent it + transport used
+type receivedPacket struct {
+	data    []byte
+	address *net.UDPAddr
+	tcp     bool
+}
+
+// tcpConnection struct: persistent connection with a peer
+type tcpConnection struct {
+	connection net.Conn
+	// frames must not be interleaved
+	mutex sync.Mutex
+}
+
+// TCPTransport struct
+type TCPTransport struct {
+	// my gossip address, sent to peers when connecting so that they know who I am
+	address  *net.UDPAddr
+	listener net.Listener
+	// peer gossip address -> connection
+	connections map[string]*tcpConnection
+	// peer gossip address -> time of the last failed dial
+	failedDials map[string]time.Time
+	// peers being dialed in the background
+	dialing map[string]bool
+	mutex   sync.Mutex
+	// packets received are sent here
+	incoming chan *receivedPacket
+}
+
+// SetTransport sets the transport used with peers: udp, tcp or both (tcp first, udp if it fails)
+func SetTransport(mode string) error {
+	if mode != udpMode && mode != tcpMode && mode != bothMode {
+		return fmt.Errorf("unknown transport %s, must be udp, tcp or both", mode)
+	}
+	transportMode = mode
+	return nil
+}
+
+// NewTCPTransport listens for tcp connections on the gossip address
+func NewTCPTransport(address *net.UDPAddr, incoming chan *receivedPacket) *TCPTransport {
+	listener, err := net.Listen("tcp4", address.String())
+	helpers.ErrorCheck(err, true)
+
+	return &TCPTransport{
+		address:     address,
+		listener:    listener,
+		connections: make(map[string]*tcpConnection),
+		failedDials: make(map[string]time.Time),
+		dialing:     make(map[string]bool),
+		incoming:    incoming,
+	}
+}
+
+// accept connections from peers
+func (tcpTransport *TCPTransport) acceptConnections() {
+	for {
+		connection, err := tcpTransport.listener.Accept()
+		helpers.ErrorCheck(err, false)
+		if err != nil {
+			continue
+		}
+		go tcpTransport.handleAcceptedConnection(connection)
+	}
+}
+
+// the first frame of an accepted connection is the gossip address of the peer, then packets follow.
+// The address must have the ip the connection comes from, otherwise anybody could take the place of a peer
+func (tcpTransport *TCPTransport) handleAcceptedConnection(connection net.Conn) {
+	connection.SetReadDeadline(time.Now().Add(tcpDialTimeout))
+	frame, err := readFrame(connection)
+	if err != nil {
+		connection.Close()
+		return
+	}
+	connection.SetReadDeadline(time.Time{})
+
+	address, err := net.ResolveUDPAddr("udp4", string(frame))
+	if err != nil {
+		connection.Close()
+		return
+	}
+
+	remoteAddress, ok := connection.RemoteAddr().(*net.TCPAddr)
+	if !ok || !remoteAddress.IP.Equal(address.IP) {
+		if debug {
+			fmt.Println("Connection from " + connection.RemoteAddr().String() + " claiming to be " + address.String() + " rejected")
+		}
+		connection.Close()
+		return
+	}
+
+	tcpConn := &tcpConnection{connection: connection}
+
+	// keep the existing connection for sending if both peers connected at the same time
+	tcpTransport.mutex.Lock()
+	if _, loaded := tcpTransport.connections[address.String()]; !loaded {
+		tcpTransport.connections[address.String()] = tcpConn
+	}
+	delete(tcpTransport.failedDials, address.String())
+	tcpTransport.mutex.Unlock()
+
+	tcpTransport.readFrames(tcpConn, address)
+}
+
+// read packets from the connection until it's closed
+func (tcpTransport *TCPTransport) readFrames(tcpConn *tcpConnection, address *net.UDPAddr) {
+	for {
+		frame, err := readFrame(tcpConn.connection)
+		if err != nil {
+			tcpTransport.removeConnection(address, tcpConn)
+			return
+		}
+		tcpTransport.incoming <- &receivedPacket{data: frame, address: address, tcp: true}
+	}
+}
+
+// get connection with the peer, connecting if needed
+func (tcpTransport *TCPTransport) getConnection(address *net.UDPAddr) (*tcpConnection, error) {
+	tcpTransport.mutex.Lock()
+	tcpConn, loaded := tcpTransport.connections[address.String()]
+	lastFailure, failed := tcpTransport.failedDials[address.String()]
+	tcpTransport.mutex.Unlock()
+
+	if loaded {
+		return tcpConn, nil
+	}
+
+	// don't try again too soon
+	if failed && time.Since(lastFailure) < tcpRedialTimeout {
+		return nil, fmt.Errorf("peer %s not reachable with tcp", address.String())
+	}
+
+	connection, err := net.DialTimeout("tcp4", address.String(), tcpDialTimeout)
+	if err == nil {
+		// tell the peer who I am
+		err = writeFrame(connection, []byte(tcpTransport.address.String()))
+		if err != nil {
+			connection.Close()
+		}
+	}
+
+	tcpTransport.mutex.Lock()
+	defer tcpTransport.mutex.Unlock()
+
+	if err != nil {
+		tcpTransport.failedDials[address.String()] = time.Now()
+		return nil, err
+	}
+	delete(tcpTransport.failedDials, address.String())
+
+	tcpConn = &tcpConnection{connection: connection}
+	if existing, loaded := tcpTransport.connections[address.String()]; loaded {
+		// connected meanwhile, only receive on this one
+		go tcpTransport.readFrames(tcpConn, address)
+		return existing, nil
+	}
+
+	tcpTransport.connections[address.String()] = tcpConn
+	go tcpTransport.readFrames(tcpConn, address)
+
+	return tcpConn, nil
+}
+
+// remove connection with the peer and close it
+func (tcpTransport *TCPTransport) removeConnection(address *net.UDPAddr, tcpConn *tcpConnection) {
+	tcpTransport.mutex.Lock()
+	if tcpTransport.connections[address.String()] == tcpConn {
+		delete(tcpTransport.connections, address.String())
+	}
+	tcpTransport.mutex.Unlock()
+
+	tcpConn.connection.Close()
+}
+
+// connect checks if the peer can be reached with tcp, connecting if needed
+func (tcpTransport *TCPTransport) connect(address *net.UDPAddr) error {
+	_, err := tcpTransport.getConnection(address)
+	return err
+}
+
+// isConnected checks if there's a connection with the peer, otherwise it starts connecting in the background without waiting
+func (tcpTransport *TCPTransport) isConnected(address *net.UDPAddr) bool {
+	tcpTransport.mutex.Lock()
+	defer tcpTransport.mutex.Unlock()
+
+	if _, loaded := tcpTransport.connections[address.String()]; loaded {
+		return true
+	}
+
+	// already connecting or failed recently
+	lastFailure, failed := tcpTransport.failedDials[address.String()]
+	if tcpTransport.dialing[address.String()] || (failed && time.Since(lastFailure) < tcpRedialTimeout) {
+		return false
+	}
+
+	tcpTransport.dialing[address.String()] = true
+	go func() {
+		tcpTransport.connect(address)
+
+		tcpTransport.mutex.Lock()
+		delete(tcpTransport.dialing, address.String())
+		tcpTransport.mutex.Unlock()
+	}()
+
+	return false
+}
+
+// close the connection with the peer, if any
+func (tcpTransport *TCPTransport) closeConnection(address *net.UDPAddr) {
+	tcpTransport.mutex.Lock()
+	tcpConn, loaded := tcpTransport.connections[address.String()]
+	delete(tcpTransport.connections, address.String())
+	delete(tcpTransport.failedDials, address.String())
+	tcpTransport.mutex.Unlock()
+
+	if loaded {
+		tcpConn.connection.Close()
+	}
+}
+
+// send encoded packet to the peer, reconnecting once if the connection broke
+func (tcpTransport *TCPTransport) send(packetBytes []byte, address *net.UDPAddr) error {
+	for attempt := 0; attempt < 2; attempt++ {
+		tcpConn, err := tcpTransport.getConnection(address)
+		if err != nil {
+			return err
+		}
+
+		err = tcpConn.write(packetBytes)
+		if err == nil {
+			return nil
+		}
+		tcpTransport.removeConnection(address, tcpConn)
+	}
+	return fmt.Errorf("failed to send packet to %s with tcp", address.String())
+}
+
+// write packet as a single frame
+func (tcpConn *tcpConnection) write(packetBytes []byte) error {
+	tcpConn.mutex.Lock()
+	defer tcpConn.mutex.Unlock()
+
+	tcpConn.connection.SetWriteDeadline(time.Now().Add(tcpDialTimeout))
+	return writeFrame(tcpConn.connection, packetBytes)
+}
+
+// frame: length | data
+func writeFrame(connection net.Conn, data []byte) error {
+	frame := make([]byte, frameLengthSize+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[frameLengthSize:], data)
+	_, err := connection.Write(frame)
+	return err
+}
+
+// read a whole frame
+func readFrame(connection net.Conn) ([]byte, error) {
+	header := make([]byte, frameLengthSize)
+	_, err := io.ReadFull(connection, header)
+	if err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header)
+	if size > uint32(maxFrameSize) {
+		return nil, fmt.Errorf("frame too big")
+	}
+
+	data := make([]byte, size)
+	_, err = io.ReadFull(connection, data)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
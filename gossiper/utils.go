@@ -46,6 +46,12 @@ func getTypeFromGossip(packet *GossipPacket) string {
 		return "whisperPacket"
 	} else if packet.WhisperStatus != nil {
 		return "whisperStatus"
+	} else if packet.PeerExchange != nil {
+		return "peerExchange"
+	} else if packet.Heartbeat != nil {
+		return "heartbeat"
+	} else if packet.KeyRotation != nil {
+		return "keyRotation"
 	}
 
 	return "unknown"
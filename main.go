@@ -7,6 +7,7 @@ import (
 	"github.com/mikanikos/Peerster/helpers"
 	"github.com/mikanikos/Peerster/webserver"
 	"github.com/mikanikos/Peerster/whisper"
+	"time"
 )
 
 // main entry point of the peerster app
@@ -14,6 +15,9 @@ func main() {
 
 	// parsing arguments according to the specification given
 	guiPort := flag.String("GUIPort", "", "port for the graphical interface")
+	rpcPort := flag.String("RPCPort", "", "port for the whisper json-rpc api over http and websocket")
+	rpcHost := flag.String("RPCHost", "127.0.0.1", "interface the whisper json-rpc api listens on, all the interfaces if empty")
+	rpcOrigins := flag.String("RPCOrigins", "", "comma separated list of web origins (e.g. http://localhost:8080) allowed to call the json-rpc api from a browser")
 	uiPort := flag.String("UIPort", "8080", "port for the command line interface")
 	gossipAddr := flag.String("gossipAddr", "127.0.0.1:5000", "ip:port for the gossiper")
 	gossipName := flag.String("name", "", "name of the gossiper")
@@ -28,23 +32,84 @@ func main() {
 	rtimer := flag.Uint("rtimer", 0, "timeout in seconds to send route rumors")
 	hopLimit := flag.Uint("hopLimit", 10, "hop limit value (TTL) for a packet")
 	stubbornTimeout := flag.Uint("stubbornTimeout", 5, "stubborn timeout to resend a txn BlockPublish until it receives a majority of acks")
+	mailServer := flag.String("mailServer", "", "folder where whisper envelopes are archived, enables the mail server mode")
+	mailRetention := flag.Uint("mailRetention", 720, "hours archived envelopes are kept by the mail server")
+	keyStore := flag.String("keyStore", "", "folder where whisper keys are persisted")
+	passphraseFile := flag.String("passphraseFile", "", "file with the passphrase used to encrypt the whisper keys in the key store, read from the WHISPER_PASSPHRASE environment variable if not given")
+	mtu := flag.Uint("mtu", 60000, "maximum size in bytes of a datagram, bigger packets are fragmented")
+	transport := flag.String("transport", "udp", "transport used with peers: udp, tcp or both (tcp with udp fallback)")
+	linkKey := flag.String("linkKey", "", "file with the key pair of the node (created if missing), enables encrypted and authenticated links with peers")
+	targetPeers := flag.Uint("targetPeers", 0, "number of peers to reach by asking known peers for others, 0 disables discovery")
+	bootstrap := flag.String("bootstrap", "", "file with the addresses of the bootstrap nodes, one ip:port per line")
+	peerTimeout := flag.Uint("peerTimeout", 60, "timeout in seconds after which a peer that doesn't answer is evicted, 0 disables eviction")
+	routeTimeout := flag.Uint("routeTimeout", 300, "timeout in seconds after which a route that is not refreshed expires, 0 disables expiration")
+	maxPeers := flag.Uint("maxPeers", 32, "maximum number of peers, half for the ones I choose and half for the ones contacting me, 0 for no limit")
+	staticPeers := flag.String("staticPeers", "", "comma separated list of peers of the form ip:port that are never dropped")
+	identityKey := flag.String("identityKey", "", "file with the long-term key the name of the node is bound to (created if missing), <name>.identity in the Peerster folder of the user config directory if not specified")
+	rotateIdentity := flag.Bool("rotateIdentity", false, "replace the long-term key with a new one and tell peers to bind the name to it")
+	allowedPeers := flag.String("allowedPeers", "", "comma separated list of hex public keys of the peers allowed on secure links, any peer if empty")
 
 	flag.Parse()
 
 	// set flags that are used througout the application
 	gossiper.SetAppConstants(*simple, *hw3ex2, *hw3ex3, *hw3ex4, *ackAll, *hopLimit, *stubbornTimeout, *rtimer, *antiEntropy)
+	err := gossiper.SetMTU(*mtu)
+	helpers.ErrorCheck(err, true)
+	err = gossiper.SetTransport(*transport)
+	helpers.ErrorCheck(err, true)
+	err = gossiper.SetDiscovery(*targetPeers, *bootstrap)
+	helpers.ErrorCheck(err, true)
+	gossiper.SetPeerTimeout(*peerTimeout)
+	gossiper.SetRouteTimeout(*routeTimeout)
+	err = gossiper.SetPeerLimits(*maxPeers, *staticPeers)
+	helpers.ErrorCheck(err, true)
+	// keep the same key across runs, peers bind the name to the first key they see
+	if *identityKey == "" {
+		*identityKey, err = gossiper.DefaultIdentityFile(*gossipName)
+		helpers.ErrorCheck(err, true)
+	}
+	if *rotateIdentity {
+		err = gossiper.RotateIdentity(*identityKey)
+	} else {
+		err = gossiper.LoadIdentity(*identityKey)
+	}
+	helpers.ErrorCheck(err, true)
+	if *linkKey != "" {
+		err = gossiper.EnableSecureLinks(*linkKey, *allowedPeers)
+		helpers.ErrorCheck(err, true)
+	}
 
 	// create new gossiper instance
 	g := gossiper.NewGossiper(*gossipName, *gossipAddr, helpers.BaseAddress+":"+*uiPort, *peers, *peersNumber)
 
 	w := whisper.NewWhisper(g)
 
+	// if key store folder specified, reload persisted keys and persist new ones
+	if *keyStore != "" {
+		passphrase, err := whisper.ReadPassphrase(*passphraseFile)
+		helpers.ErrorCheck(err, true)
+		err = w.OpenKeyStore(*keyStore, passphrase)
+		helpers.ErrorCheck(err, true)
+	}
+
+	// if archive folder specified, keep envelopes for peers that were offline
+	if *mailServer != "" {
+		err := w.EnableMailServer(*mailServer, time.Duration(*mailRetention)*time.Hour)
+		helpers.ErrorCheck(err, true)
+	}
+
 	// if gui port specified, create and run the webserver (if not, avoid waste of resources for performance reasons)
 	if *guiPort != "" {
-		ws := webserver.NewWebserver(*uiPort, g)
+		ws := webserver.NewWebserver(*uiPort, g, w)
 		go ws.Run(*guiPort)
 	}
 
+	// if rpc port specified, serve the shh api
+	if *rpcPort != "" {
+		rs := webserver.NewRPCServer(w, *rpcOrigins)
+		go rs.Run(*rpcHost, *rpcPort)
+	}
+
 	// run gossiper
 	g.Run()
 	fmt.Println("Gossiper running")
@@ -0,0 +1,69 @@
+package tests
+
+import (
+	"encoding/binary"
+	"github.com/mikanikos/Peerster/whisper"
+	"testing"
+)
+
+// build raw payload: flags | payload size | payload | padding
+func buildRaw(flags byte, size uint32, payload, padding []byte) []byte {
+	raw := []byte{flags}
+	sizeBytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(sizeBytes, size)
+	raw = append(raw, sizeBytes...)
+	raw = append(raw, payload...)
+	return append(raw, padding...)
+}
+
+// parse raw payload as the content of an envelope
+func parseRaw(raw []byte) *whisper.ReceivedMessage {
+	envelope := whisper.NewEnvelope(60, whisper.ConvertBytesToTopic([]byte("test")), raw)
+	return envelope.GetMessageFromEnvelope(&whisper.Filter{})
+}
+
+func TestParseRawPayloadBounds(t *testing.T) {
+
+	const signatureFlag = byte(4)
+
+	// no flags or no size
+	if msg := parseRaw([]byte{}); msg != nil {
+		t.Fatalf("failed when parsing empty payload: accepted")
+	}
+	if msg := parseRaw([]byte{0, 0, 0, 0}); msg != nil {
+		t.Fatalf("failed when parsing payload without size: accepted")
+	}
+
+	// empty payload is fine
+	msg := parseRaw(buildRaw(0, 0, nil, nil))
+	if msg == nil || len(msg.Payload) != 0 {
+		t.Fatalf("failed when parsing empty payload")
+	}
+
+	// whatever follows the payload is padding
+	msg = parseRaw(buildRaw(0, 3, []byte("abc"), []byte{1, 2}))
+	if msg == nil {
+		t.Fatalf("failed when parsing payload with padding")
+	}
+	if string(msg.Payload) != "abc" || len(msg.Padding) != 2 {
+		t.Fatalf("failed when parsing payload with padding: got payload %q and padding %d", msg.Payload, len(msg.Padding))
+	}
+
+	// size bigger than the data, also when it overflows
+	if msg := parseRaw(buildRaw(0, 4, []byte("abc"), nil)); msg != nil {
+		t.Fatalf("failed when parsing size bigger than data: accepted")
+	}
+	if msg := parseRaw(buildRaw(0, ^uint32(0), []byte("abc"), nil)); msg != nil {
+		t.Fatalf("failed when parsing max size: accepted")
+	}
+
+	// signed payload without room for the signature
+	if msg := parseRaw(buildRaw(signatureFlag, 3, []byte("abc"), nil)); msg != nil {
+		t.Fatalf("failed when parsing signed payload too short: accepted")
+	}
+
+	// signature that doesn't recover a valid key
+	if msg := parseRaw(buildRaw(signatureFlag, 0, nil, make([]byte, 65+64))); msg != nil {
+		t.Fatalf("failed when parsing signature with invalid key: accepted")
+	}
+}
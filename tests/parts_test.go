@@ -0,0 +1,158 @@
+package tests
+
+import (
+	"encoding/binary"
+	"github.com/mikanikos/Peerster/whisper"
+	"strings"
+	"testing"
+)
+
+// build raw payload of a message part: flags | part id (16 bytes) | index | count | payload size | payload | padding
+func buildPartRaw(id string, index, count uint16, payload string, padding []byte) []byte {
+	raw := make([]byte, 1+16+2+2+4)
+	raw[0] = byte(8)
+	copy(raw[1:17], id)
+	binary.BigEndian.PutUint16(raw[17:], index)
+	binary.BigEndian.PutUint16(raw[19:], count)
+	binary.BigEndian.PutUint32(raw[21:], uint32(len(payload)))
+	raw = append(raw, payload...)
+	return append(raw, padding...)
+}
+
+// parse raw payload of a part as the content of an envelope
+func parsePart(raw []byte) *whisper.ReceivedMessage {
+	envelope := whisper.NewEnvelope(60, whisper.ConvertBytesToTopic([]byte("test")), raw)
+	return envelope.GetMessageFromEnvelope(&whisper.Filter{})
+}
+
+// create filter storage with a single filter on the test topic
+func newPartsFilter(t *testing.T) (*whisper.FilterStorage, *whisper.Filter) {
+	filters := whisper.NewFilterStorage()
+	topic := whisper.ConvertBytesToTopic([]byte("test"))
+	filter := &whisper.Filter{Topics: [][]byte{topic[:]}}
+	_, err := filters.AddFilter(filter)
+	if err != nil {
+		t.Fatalf("failed when adding filter: %s", err)
+	}
+	return filters, filter
+}
+
+// deliver part to the filters
+func sendPart(filters *whisper.FilterStorage, id string, index, count uint16, payload string, padding []byte) {
+	filters.NotifySubscribers(whisper.NewEnvelope(60, whisper.ConvertBytesToTopic([]byte("test")), buildPartRaw(id, index, count, payload, padding)))
+}
+
+func TestParsePartBounds(t *testing.T) {
+
+	// part flag without room for the part header
+	if msg := parsePart([]byte{8, 0, 0, 0, 0}); msg != nil {
+		t.Fatalf("failed when parsing part header too short: accepted")
+	}
+
+	// part count and index must be consistent and at most 1024 parts are allowed
+	if msg := parsePart(buildPartRaw("0123456789abcdef", 0, 0, "", nil)); msg != nil {
+		t.Fatalf("failed when parsing part count zero: accepted")
+	}
+	if msg := parsePart(buildPartRaw("0123456789abcdef", 2, 2, "", nil)); msg != nil {
+		t.Fatalf("failed when parsing part index out of range: accepted")
+	}
+	if msg := parsePart(buildPartRaw("0123456789abcdef", 0, 1025, "", nil)); msg != nil {
+		t.Fatalf("failed when parsing too many parts: accepted")
+	}
+
+	// valid part
+	msg := parsePart(buildPartRaw("0123456789abcdef", 1, 2, "abc", nil))
+	if msg == nil || string(msg.Payload) != "abc" {
+		t.Fatalf("failed when parsing valid part")
+	}
+}
+
+func TestPartReassembly(t *testing.T) {
+
+	filters, filter := newPartsFilter(t)
+
+	// a message with a single part is not a part: no flags, size and payload
+	filters.NotifySubscribers(whisper.NewEnvelope(60, whisper.ConvertBytesToTopic([]byte("test")), append([]byte{0, 0, 0, 0, 5}, "hello"...)))
+	messages := filter.GetReceivedMessagesFromFilter()
+	if len(messages) != 1 || string(messages[0].Payload) != "hello" {
+		t.Fatalf("failed when receiving single message")
+	}
+
+	// parts out of order, the padding comes from the last one
+	sendPart(filters, "a", 2, 3, "c", []byte{1, 2, 3})
+	sendPart(filters, "a", 0, 3, "a", nil)
+	if messages := filter.GetReceivedMessagesFromFilter(); len(messages) != 0 {
+		t.Fatalf("failed when waiting for missing part: message delivered")
+	}
+	sendPart(filters, "a", 1, 3, "b", nil)
+	messages = filter.GetReceivedMessagesFromFilter()
+	if len(messages) != 1 || string(messages[0].Payload) != "abc" || len(messages[0].Padding) != 3 {
+		t.Fatalf("failed when reassembling parts out of order")
+	}
+
+	// a duplicate part is ignored
+	sendPart(filters, "b", 0, 2, "a", nil)
+	sendPart(filters, "b", 0, 2, "x", nil)
+	sendPart(filters, "b", 1, 2, "b", nil)
+	messages = filter.GetReceivedMessagesFromFilter()
+	if len(messages) != 1 || string(messages[0].Payload) != "ab" {
+		t.Fatalf("failed when ignoring duplicate part")
+	}
+
+	// parts with a different count don't belong to the message
+	sendPart(filters, "c", 0, 2, "a", nil)
+	sendPart(filters, "c", 1, 3, "b", nil)
+	if messages := filter.GetReceivedMessagesFromFilter(); len(messages) != 0 {
+		t.Fatalf("failed when ignoring inconsistent count: message delivered")
+	}
+
+	// interleaved messages are reassembled separately
+	sendPart(filters, "d", 0, 2, "d1", nil)
+	sendPart(filters, "e", 1, 2, "e2", nil)
+	sendPart(filters, "d", 1, 2, "d2", nil)
+	sendPart(filters, "e", 0, 2, "e1", nil)
+	messages = filter.GetReceivedMessagesFromFilter()
+	if len(messages) != 2 {
+		t.Fatalf("failed when reassembling interleaved messages: got %d messages", len(messages))
+	}
+	for _, msg := range messages {
+		if string(msg.Payload) != "d1d2" && string(msg.Payload) != "e1e2" {
+			t.Fatalf("failed when reassembling interleaved messages: got %q", msg.Payload)
+		}
+	}
+}
+
+func TestPartialMessagesLimits(t *testing.T) {
+
+	filters, filter := newPartsFilter(t)
+
+	// fill the pending messages of the filter, 16 at most
+	ids := "ABCDEFGHIJKLMNOP"
+	for _, id := range ids {
+		sendPart(filters, string(id), 0, 2, "a", nil)
+	}
+
+	// a new message is dropped while the filter is full
+	sendPart(filters, "Q", 0, 2, "a", nil)
+	sendPart(filters, "Q", 1, 2, "b", nil)
+	if messages := filter.GetReceivedMessagesFromFilter(); len(messages) != 0 {
+		t.Fatalf("failed when dropping message over the pending limit: message delivered")
+	}
+
+	// the pending ones can still complete
+	sendPart(filters, "A", 1, 2, "b", nil)
+	messages := filter.GetReceivedMessagesFromFilter()
+	if len(messages) != 1 || string(messages[0].Payload) != "ab" {
+		t.Fatalf("failed when completing pending message")
+	}
+
+	filters, filter = newPartsFilter(t)
+
+	// a message bigger than the maximum size is dropped, even if all its parts arrive
+	half := strings.Repeat("x", int(whisper.MaxMessageSize)/2+1)
+	sendPart(filters, "big", 0, 2, half, nil)
+	sendPart(filters, "big", 1, 2, half, nil)
+	if messages := filter.GetReceivedMessagesFromFilter(); len(messages) != 0 {
+		t.Fatalf("failed when dropping message bigger than the maximum size: message delivered")
+	}
+}
@@ -189,6 +189,132 @@ func TestSimpleAsym(t *testing.T) {
 	}
 }
 
+func TestSignedSym(t *testing.T) {
+
+	// create new gossiper instance
+	g1 := gossiper.NewGossiper("A", "127.0.0.1:5010", helpers.BaseAddress+":10010", "127.0.0.1:5011", 0)
+	g2 := gossiper.NewGossiper("B", "127.0.0.1:5011", helpers.BaseAddress+":10011", "127.0.0.1:5010", 0)
+
+	w1 := whisper.NewWhisper(g1)
+	w2 := whisper.NewWhisper(g2)
+
+	g1.Run()
+	w1.Run()
+
+	g2.Run()
+	w2.Run()
+
+	symKeyID1, err := w1.GenerateSymKey()
+	if err != nil {
+		t.Fatalf("failed when creating sym key: %s", err)
+	}
+
+	symKey, err := w1.GetSymKeyFromID(symKeyID1)
+	if err != nil {
+		t.Fatalf("failed when getting sym key: %s", err)
+	}
+
+	symKeyID2, err := w2.AddSymKey(hex.EncodeToString(symKey))
+	if err != nil {
+		t.Fatalf("failed when adding sym key: %s", err)
+	}
+
+	signKeyID, err := w2.NewKeyPair()
+	if err != nil {
+		t.Fatalf("failed when creating key pair: %s", err)
+	}
+
+	signPubKey, err := w2.GetPublicKeyFromID(signKeyID)
+	if err != nil {
+		t.Fatalf("failed when getting pub key: %s", err)
+	}
+
+	time.Sleep(time.Second)
+
+	topics := make([]whisper.Topic, 0)
+	topics = append(topics, whisper.ConvertBytesToTopic([]byte("ciao")))
+	crit := whisper.FilterOptions{
+		SymKeyID: symKeyID1,
+		MinPow:   0.2,
+		Topics:   topics,
+	}
+
+	filterHash, err := w1.NewMessageFilter(crit)
+	if err != nil {
+		t.Fatalf("failed when creating new filter: %s", err)
+	}
+
+	// let the status update propagate
+	time.Sleep(time.Second * time.Duration(2))
+
+	text := "ciao andrea"
+	newMessage := whisper.NewMessage{
+		SymKeyID: symKeyID2,
+		Sig:      signKeyID,
+		TTL:      60,
+		Topic:    whisper.ConvertBytesToTopic([]byte("ciao")),
+		Payload:  []byte(text),
+		PowTime:  2,
+	}
+
+	_, err = w2.NewWhisperMessage(newMessage)
+	if err != nil {
+		t.Fatalf("failed when creating new message: %s", err)
+	}
+
+	// let the message propagate
+	time.Sleep(time.Second * time.Duration(2))
+
+	mess, err := w1.GetFilterMessages(filterHash)
+	if err != nil {
+		t.Fatalf("failed retrieving messages: %s", err)
+	}
+
+	if len(mess) != 1 {
+		t.Fatalf("no message but expected")
+	}
+
+	for _, m := range mess {
+		if string(m.Payload) != text {
+			t.Fatalf("message is not expected : %s", string(m.Payload))
+		}
+		if m.Src == nil || hex.EncodeToString(m.Src.Bytes(false)) != hex.EncodeToString(signPubKey) {
+			t.Fatalf("sender key not recovered from signature")
+		}
+	}
+}
+
+func TestSymKeyFromPassword(t *testing.T) {
+
+	// no need to run the protocol, keys are derived locally
+	w1 := whisper.NewWhisper(nil)
+	w2 := whisper.NewWhisper(nil)
+
+	symKeyID1, err := w1.GenerateSymKeyFromPassword("ciao andrea")
+	if err != nil {
+		t.Fatalf("failed when deriving sym key: %s", err)
+	}
+
+	symKeyID2, err := w2.GenerateSymKeyFromPassword("ciao andrea")
+	if err != nil {
+		t.Fatalf("failed when deriving sym key: %s", err)
+	}
+
+	symKey1, err := w1.GetSymKeyFromID(symKeyID1)
+	if err != nil {
+		t.Fatalf("failed when getting sym key: %s", err)
+	}
+
+	symKey2, err := w2.GetSymKeyFromID(symKeyID2)
+	if err != nil {
+		t.Fatalf("failed when getting sym key: %s", err)
+	}
+
+	if hex.EncodeToString(symKey1) != hex.EncodeToString(symKey2) {
+		t.Fatalf("same password gave different keys")
+	}
+}
+
 //func TestGossip(t *testing.T) {
 //
 //	// create new gossiper instance
@@ -0,0 +1,402 @@
+package webserver
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/mikanikos/Peerster/helpers"
+	"github.com/mikanikos/Peerster/whisper"
+)
+
+// json-rpc 2.0 error codes
+const (
+	parseErrorCode     = -32700
+	invalidRequestCode = -32600
+	methodNotFoundCode = -32601
+	invalidParamsCode  = -32602
+	serverErrorCode    = -32000
+
+	maxRequestSize = 5 * 1024 * 1024
+)
+
+// RPCServer serves the whisper api as json-rpc 2.0 over http and websocket
+type RPCServer struct {
+	methods             map[string]rpcMethod
+	subscriptionMethods map[string]rpcSubscriptionMethod
+	upgrader            websocket.Upgrader
+	// web origins allowed to call the api from a browser
+	allowedOrigins map[string]bool
+}
+
+// rpcMethod handles the positional parameters of a request and returns the result
+type rpcMethod func(params json.RawMessage) (interface{}, error)
+
+// rpcSubscriptionMethod needs the websocket connection to push notifications
+type rpcSubscriptionMethod func(conn *rpcConnection, params json.RawMessage) (interface{}, error)
+
+// rpcConnection is a websocket connection with the subscriptions created through it
+type rpcConnection struct {
+	conn          *websocket.Conn
+	writeMutex    sync.Mutex
+	subscriptions map[string]func()
+	mutex         sync.Mutex
+}
+
+// rpcNotification struct
+type rpcNotification struct {
+	JSONRPC string                `json:"jsonrpc"`
+	Method  string                `json:"method"`
+	Params  rpcSubscriptionResult `json:"params"`
+}
+
+// rpcSubscriptionResult struct, error set if something went wrong with the subscription (e.g. messages lost)
+type rpcSubscriptionResult struct {
+	Subscription string      `json:"subscription"`
+	Result       interface{} `json:"result,omitempty"`
+	Error        *rpcError   `json:"error,omitempty"`
+}
+
+// rpcRequest struct
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+// rpcResponse struct
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+// rpcError struct
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// hexBytes is a byte array encoded as 0x-prefixed hex string in json
+type hexBytes []byte
+
+// MarshalJSON encodes bytes as 0x-prefixed hex string
+func (b hexBytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal("0x" + hex.EncodeToString(b))
+}
+
+// UnmarshalJSON decodes a 0x-prefixed hex string
+func (b *hexBytes) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+	decoded, err := hex.DecodeString(strings.TrimPrefix(s, "0x"))
+	if err != nil {
+		return fmt.Errorf("invalid hex string %s", s)
+	}
+	*b = decoded
+	return nil
+}
+
+// NewRPCServer for the whisper instance given, with the shh namespace.
+// Browsers can call the api only from the origins given (comma separated), requests without origin come from other clients and are accepted
+func NewRPCServer(w *whisper.Whisper, allowedOrigins string) *RPCServer {
+	api := newShhAPI(w)
+	rpcServer := &RPCServer{
+		methods:             api.methods(),
+		subscriptionMethods: api.subscriptionMethods(),
+		allowedOrigins:      make(map[string]bool),
+	}
+
+	if allowedOrigins != "" {
+		for _, origin := range strings.Split(allowedOrigins, ",") {
+			rpcServer.allowedOrigins[strings.TrimSpace(origin)] = true
+		}
+	}
+
+	rpcServer.upgrader = websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin:     rpcServer.checkOrigin,
+	}
+
+	return rpcServer
+}
+
+// Run rpc server to handle http post requests and websocket connections, only on the host given (all the interfaces if empty)
+func (rpcServer *RPCServer) Run(hostRPC, portRPC string) {
+
+	r := mux.NewRouter()
+
+	r.HandleFunc("/", rpcServer.rpcHandler)
+
+	log.Fatal(http.ListenAndServe(net.JoinHostPort(hostRPC, portRPC), r))
+}
+
+// check that the request doesn't come from a web page of an origin not allowed
+func (rpcServer *RPCServer) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	return origin == "" || rpcServer.allowedOrigins[origin]
+}
+
+// handle both websocket upgrades and http post requests
+func (rpcServer *RPCServer) rpcHandler(w http.ResponseWriter, r *http.Request) {
+	if !rpcServer.checkOrigin(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+
+	if websocket.IsWebSocketUpgrade(r) {
+		rpcServer.serveWebSocket(w, r)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(rpcServer.handleMessage(body, nil))
+}
+
+// serve requests of a websocket connection until it's closed, then cancel its subscriptions
+func (rpcServer *RPCServer) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := rpcServer.upgrader.Upgrade(w, r, nil)
+	helpers.ErrorCheck(err, false)
+	if err != nil {
+		return
+	}
+
+	rpcConn := &rpcConnection{conn: conn, subscriptions: make(map[string]func())}
+	defer rpcConn.close()
+
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		response := rpcServer.handleMessage(message, rpcConn)
+		if response == nil {
+			continue
+		}
+
+		err = rpcConn.write(response)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// write message on the websocket, responses and notifications are written by different goroutines
+func (rpcConn *rpcConnection) write(message []byte) error {
+	rpcConn.writeMutex.Lock()
+	defer rpcConn.writeMutex.Unlock()
+	return rpcConn.conn.WriteMessage(websocket.TextMessage, message)
+}
+
+// notify the client with a new result for the subscription
+func (rpcConn *rpcConnection) notify(method, subscription string, result interface{}) error {
+	return rpcConn.sendNotification(&rpcNotification{JSONRPC: "2.0", Method: method, Params: rpcSubscriptionResult{Subscription: subscription, Result: result}})
+}
+
+// notify the client with an error of the subscription
+func (rpcConn *rpcConnection) notifyError(method, subscription string, subscriptionErr error) error {
+	rpcErr := &rpcError{Code: serverErrorCode, Message: subscriptionErr.Error()}
+	return rpcConn.sendNotification(&rpcNotification{JSONRPC: "2.0", Method: method, Params: rpcSubscriptionResult{Subscription: subscription, Error: rpcErr}})
+}
+
+// encode and write the notification
+func (rpcConn *rpcConnection) sendNotification(notification *rpcNotification) error {
+	encoded, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	return rpcConn.write(encoded)
+}
+
+// add subscription with its cancel function
+func (rpcConn *rpcConnection) addSubscription(id string, unsubscribe func()) {
+	rpcConn.mutex.Lock()
+	defer rpcConn.mutex.Unlock()
+	rpcConn.subscriptions[id] = unsubscribe
+}
+
+// remove and cancel subscription, return false if not found
+func (rpcConn *rpcConnection) removeSubscription(id string) bool {
+	rpcConn.mutex.Lock()
+	unsubscribe, loaded := rpcConn.subscriptions[id]
+	delete(rpcConn.subscriptions, id)
+	rpcConn.mutex.Unlock()
+
+	if loaded {
+		unsubscribe()
+	}
+	return loaded
+}
+
+// cancel all the subscriptions and close the connection
+func (rpcConn *rpcConnection) close() {
+	rpcConn.mutex.Lock()
+	subscriptions := rpcConn.subscriptions
+	rpcConn.subscriptions = make(map[string]func())
+	rpcConn.mutex.Unlock()
+
+	for _, unsubscribe := range subscriptions {
+		unsubscribe()
+	}
+	rpcConn.conn.Close()
+}
+
+// handle a single request or a batch of requests and return the encoded response (nil if only notifications)
+func (rpcServer *RPCServer) handleMessage(message []byte, conn *rpcConnection) []byte {
+	message = bytes.TrimSpace(message)
+
+	// batch of requests
+	if len(message) > 0 && message[0] == '[' {
+		var batch []json.RawMessage
+		err := json.Unmarshal(message, &batch)
+		if err != nil || len(batch) == 0 {
+			return encodeResponse(newErrorResponse(nil, invalidRequestCode, "invalid batch"))
+		}
+
+		responses := make([]*rpcResponse, 0, len(batch))
+		for _, req := range batch {
+			if response := rpcServer.handleRequest(req, conn); response != nil {
+				responses = append(responses, response)
+			}
+		}
+		if len(responses) == 0 {
+			return nil
+		}
+		return encodeResponse(responses)
+	}
+
+	response := rpcServer.handleRequest(message, conn)
+	if response == nil {
+		return nil
+	}
+	return encodeResponse(response)
+}
+
+// handle a single request, notifications (without id) get no response
+func (rpcServer *RPCServer) handleRequest(message []byte, conn *rpcConnection) *rpcResponse {
+	request := &rpcRequest{}
+	err := json.Unmarshal(message, request)
+	if err != nil {
+		return newErrorResponse(nil, parseErrorCode, err.Error())
+	}
+
+	if request.JSONRPC != "2.0" || request.Method == "" {
+		return newErrorResponse(request.ID, invalidRequestCode, "invalid request")
+	}
+
+	method, found := rpcServer.methods[request.Method]
+
+	// subscriptions are only available with websocket
+	if subscriptionMethod, isSubscription := rpcServer.subscriptionMethods[request.Method]; isSubscription {
+		found = true
+		method = func(params json.RawMessage) (interface{}, error) {
+			if conn == nil {
+				return nil, fmt.Errorf("notifications not supported")
+			}
+			return subscriptionMethod(conn, params)
+		}
+	}
+
+	// notifications are executed without response
+	if request.ID == nil {
+		if found {
+			method(request.Params)
+		}
+		return nil
+	}
+
+	if !found {
+		return newErrorResponse(request.ID, methodNotFoundCode, "the method "+request.Method+" does not exist/is not available")
+	}
+
+	result, err := method(request.Params)
+
+	if err != nil {
+		if paramsErr, ok := err.(*invalidParamsError); ok {
+			return newErrorResponse(request.ID, invalidParamsCode, paramsErr.Error())
+		}
+		return newErrorResponse(request.ID, serverErrorCode, err.Error())
+	}
+
+	encoded, err := json.Marshal(result)
+	if err != nil {
+		return newErrorResponse(request.ID, serverErrorCode, err.Error())
+	}
+
+	return &rpcResponse{JSONRPC: "2.0", ID: request.ID, Result: encoded}
+}
+
+// create response with error
+func newErrorResponse(id json.RawMessage, code int, message string) *rpcResponse {
+	return &rpcResponse{JSONRPC: "2.0", ID: id, Error: &rpcError{Code: code, Message: message}}
+}
+
+// encode response, if it fails nothing is sent
+func encodeResponse(response interface{}) []byte {
+	encoded, err := json.Marshal(response)
+	helpers.ErrorCheck(err, false)
+	return encoded
+}
+
+// invalidParamsError is returned when the parameters of a request can't be parsed
+type invalidParamsError struct {
+	message string
+}
+
+func (e *invalidParamsError) Error() string {
+	return e.message
+}
+
+// parse positional parameters in the arguments given, all arguments are required
+func parseParams(params json.RawMessage, args ...interface{}) error {
+	var values []json.RawMessage
+	if len(params) > 0 {
+		err := json.Unmarshal(params, &values)
+		if err != nil {
+			return &invalidParamsError{message: "non-array args"}
+		}
+	}
+
+	if len(values) < len(args) {
+		return &invalidParamsError{message: fmt.Sprintf("missing value for required argument %d", len(values))}
+	}
+	if len(values) > len(args) {
+		return &invalidParamsError{message: fmt.Sprintf("too many arguments, want at most %d", len(args))}
+	}
+
+	for i, arg := range args {
+		err := json.Unmarshal(values[i], arg)
+		if err != nil {
+			return &invalidParamsError{message: fmt.Sprintf("invalid argument %d: %s", i, err)}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,475 @@
+package webserver
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/mikanikos/Peerster/whisper"
+)
+
+// whisper protocol version exposed through shh_version
+const shhVersion = "6.0"
+
+// shhAPI exposes the whisper api with the shh json-rpc namespace
+type shhAPI struct {
+	whisper *whisper.Whisper
+}
+
+// shhInfo struct
+type shhInfo struct {
+	Memory         int     `json:"memory"`
+	Messages       int     `json:"messages"`
+	MinPow         float64 `json:"minPow"`
+	MaxMessageSize uint32  `json:"maxMessageSize"`
+}
+
+// shhNewMessage struct, parameters of shh_post
+type shhNewMessage struct {
+	SymKeyID  string   `json:"symKeyID"`
+	PublicKey hexBytes `json:"pubKey"`
+	Sig       string   `json:"sig"`
+	TTL       uint32   `json:"ttl"`
+	Topic     hexBytes `json:"topic"`
+	Payload   hexBytes `json:"payload"`
+	Padding   hexBytes `json:"padding"`
+	PowTime   uint32   `json:"powTime"`
+	PowTarget float64  `json:"powTarget"`
+}
+
+// shhCriteria struct, parameters of shh_newMessageFilter
+type shhCriteria struct {
+	SymKeyID     string     `json:"symKeyID"`
+	PrivateKeyID string     `json:"privateKeyID"`
+	MinPow       float64    `json:"minPow"`
+	Topics       []hexBytes `json:"topics"`
+}
+
+// shhMessage struct, message returned by shh_getFilterMessages
+type shhMessage struct {
+	Sig       hexBytes `json:"sig,omitempty"`
+	TTL       uint32   `json:"ttl"`
+	Timestamp uint32   `json:"timestamp"`
+	Topic     hexBytes `json:"topic"`
+	Payload   hexBytes `json:"payload"`
+	Padding   hexBytes `json:"padding"`
+	Pow       float64  `json:"pow"`
+	Hash      hexBytes `json:"hash"`
+	Dst       hexBytes `json:"recipientPublicKey,omitempty"`
+}
+
+// shhBannedPeer struct, peer returned by shh_getBannedPeers
+type shhBannedPeer struct {
+	Address     string `json:"address"`
+	BannedUntil int64  `json:"bannedUntil"`
+}
+
+// shhRateLimits struct, limits of incoming packets per second (0 means no limit)
+type shhRateLimits struct {
+	PeerEnvelopes   float64 `json:"peerEnvelopes"`
+	PeerBytes       float64 `json:"peerBytes"`
+	IPEnvelopes     float64 `json:"ipEnvelopes"`
+	IPBytes         float64 `json:"ipBytes"`
+	GlobalEnvelopes float64 `json:"globalEnvelopes"`
+	GlobalBytes     float64 `json:"globalBytes"`
+}
+
+// create shh api for the whisper instance given
+func newShhAPI(w *whisper.Whisper) *shhAPI {
+	return &shhAPI{whisper: w}
+}
+
+// get all the methods of the shh namespace
+func (api *shhAPI) methods() map[string]rpcMethod {
+	return map[string]rpcMethod{
+		"shh_version":                    api.version,
+		"shh_info":                       api.info,
+		"shh_setMinPoW":                  api.setMinPoW,
+		"shh_setMaxMessageSize":          api.setMaxMessageSize,
+		"shh_setBloomFilter":             api.setBloomFilter,
+		"shh_newKeyPair":                 api.newKeyPair,
+		"shh_addPrivateKey":              api.addPrivateKey,
+		"shh_deleteKeyPair":              api.deleteKeyPair,
+		"shh_hasKeyPair":                 api.hasKeyPair,
+		"shh_getPublicKey":               api.getPublicKey,
+		"shh_getPrivateKey":              api.getPrivateKey,
+		"shh_newSymKey":                  api.newSymKey,
+		"shh_addSymKey":                  api.addSymKey,
+		"shh_generateSymKeyFromPassword": api.generateSymKeyFromPassword,
+		"shh_hasSymKey":                  api.hasSymKey,
+		"shh_getSymKey":                  api.getSymKey,
+		"shh_deleteSymKey":               api.deleteSymKey,
+		"shh_post":                       api.post,
+		"shh_newMessageFilter":           api.newMessageFilter,
+		"shh_getFilterMessages":          api.getFilterMessages,
+		"shh_deleteMessageFilter":        api.deleteMessageFilter,
+		"shh_getBannedPeers":             api.getBannedPeers,
+		"shh_unbanPeer":                  api.unbanPeer,
+		"shh_getRateLimits":              api.getRateLimits,
+		"shh_setRateLimits":              api.setRateLimits,
+	}
+}
+
+// get the methods of the shh namespace that need a websocket connection
+func (api *shhAPI) subscriptionMethods() map[string]rpcSubscriptionMethod {
+	return map[string]rpcSubscriptionMethod{
+		"shh_subscribe":   api.subscribe,
+		"shh_unsubscribe": api.unsubscribe,
+	}
+}
+
+// parse the only string parameter of a request
+func parseStringParam(params json.RawMessage) (string, error) {
+	var value string
+	err := parseParams(params, &value)
+	return value, err
+}
+
+// parse the only hex parameter of a request
+func parseHexParam(params json.RawMessage) (hexBytes, error) {
+	var value hexBytes
+	err := parseParams(params, &value)
+	return value, err
+}
+
+func (api *shhAPI) version(params json.RawMessage) (interface{}, error) {
+	return shhVersion, parseParams(params)
+}
+
+func (api *shhAPI) info(params json.RawMessage) (interface{}, error) {
+	if err := parseParams(params); err != nil {
+		return nil, err
+	}
+
+	info := &shhInfo{MinPow: api.whisper.GetMinPow(), MaxMessageSize: api.whisper.GetMaxMessageSize()}
+	for _, envelope := range api.whisper.Envelopes() {
+		info.Messages++
+		info.Memory += envelope.Envelope.GetSize()
+	}
+	return info, nil
+}
+
+func (api *shhAPI) setMinPoW(params json.RawMessage) (interface{}, error) {
+	var pow float64
+	if err := parseParams(params, &pow); err != nil {
+		return nil, err
+	}
+	return true, api.whisper.SetMinPoW(pow)
+}
+
+func (api *shhAPI) setMaxMessageSize(params json.RawMessage) (interface{}, error) {
+	var size uint32
+	if err := parseParams(params, &size); err != nil {
+		return nil, err
+	}
+	return true, api.whisper.SetMaxMessageSize(size)
+}
+
+func (api *shhAPI) setBloomFilter(params json.RawMessage) (interface{}, error) {
+	bloom, err := parseHexParam(params)
+	if err != nil {
+		return nil, err
+	}
+	return true, api.whisper.SetBloomFilter(bloom)
+}
+
+func (api *shhAPI) newKeyPair(params json.RawMessage) (interface{}, error) {
+	if err := parseParams(params); err != nil {
+		return nil, err
+	}
+	return api.whisper.NewKeyPair()
+}
+
+func (api *shhAPI) addPrivateKey(params json.RawMessage) (interface{}, error) {
+	key, err := parseHexParam(params)
+	if err != nil {
+		return nil, err
+	}
+	return api.whisper.AddPrivateKey(key)
+}
+
+func (api *shhAPI) deleteKeyPair(params json.RawMessage) (interface{}, error) {
+	id, err := parseStringParam(params)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := api.whisper.GetPrivateKey(id); err != nil {
+		return false, nil
+	}
+	api.whisper.DeleteKey(id)
+	return true, nil
+}
+
+func (api *shhAPI) hasKeyPair(params json.RawMessage) (interface{}, error) {
+	id, err := parseStringParam(params)
+	if err != nil {
+		return nil, err
+	}
+	_, err = api.whisper.GetPrivateKey(id)
+	return err == nil, nil
+}
+
+func (api *shhAPI) getPublicKey(params json.RawMessage) (interface{}, error) {
+	id, err := parseStringParam(params)
+	if err != nil {
+		return nil, err
+	}
+	key, err := api.whisper.GetPublicKeyFromID(id)
+	return hexBytes(key), err
+}
+
+func (api *shhAPI) getPrivateKey(params json.RawMessage) (interface{}, error) {
+	id, err := parseStringParam(params)
+	if err != nil {
+		return nil, err
+	}
+	key, err := api.whisper.GetPrivateKeyFromID(id)
+	return hexBytes(key), err
+}
+
+func (api *shhAPI) newSymKey(params json.RawMessage) (interface{}, error) {
+	if err := parseParams(params); err != nil {
+		return nil, err
+	}
+	return api.whisper.GenerateSymKey()
+}
+
+func (api *shhAPI) addSymKey(params json.RawMessage) (interface{}, error) {
+	key, err := parseHexParam(params)
+	if err != nil {
+		return nil, err
+	}
+	return api.whisper.AddSymKey(hex.EncodeToString(key))
+}
+
+func (api *shhAPI) generateSymKeyFromPassword(params json.RawMessage) (interface{}, error) {
+	password, err := parseStringParam(params)
+	if err != nil {
+		return nil, err
+	}
+	return api.whisper.GenerateSymKeyFromPassword(password)
+}
+
+func (api *shhAPI) hasSymKey(params json.RawMessage) (interface{}, error) {
+	id, err := parseStringParam(params)
+	if err != nil {
+		return nil, err
+	}
+	_, err = api.whisper.GetSymKeyFromID(id)
+	return err == nil, nil
+}
+
+func (api *shhAPI) getSymKey(params json.RawMessage) (interface{}, error) {
+	id, err := parseStringParam(params)
+	if err != nil {
+		return nil, err
+	}
+	key, err := api.whisper.GetSymKeyFromID(id)
+	return hexBytes(key), err
+}
+
+func (api *shhAPI) deleteSymKey(params json.RawMessage) (interface{}, error) {
+	id, err := parseStringParam(params)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := api.whisper.GetSymKeyFromID(id); err != nil {
+		return false, nil
+	}
+	api.whisper.DeleteKey(id)
+	return true, nil
+}
+
+func (api *shhAPI) post(params json.RawMessage) (interface{}, error) {
+	req := &shhNewMessage{}
+	if err := parseParams(params, req); err != nil {
+		return nil, err
+	}
+
+	if len(req.Topic) != 0 && len(req.Topic) != whisper.TopicLength {
+		return nil, &invalidParamsError{message: fmt.Sprintf("topic must be %d bytes", whisper.TopicLength)}
+	}
+
+	hash, err := api.whisper.NewWhisperMessage(whisper.NewMessage{
+		SymKeyID:  req.SymKeyID,
+		PublicKey: req.PublicKey,
+		Sig:       req.Sig,
+		TTL:       req.TTL,
+		Topic:     whisper.ConvertBytesToTopic(req.Topic),
+		PowTime:   req.PowTime,
+		PowTarget: req.PowTarget,
+		Payload:   req.Payload,
+		Padding:   req.Padding,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hexBytes(hash), nil
+}
+
+func (api *shhAPI) newMessageFilter(params json.RawMessage) (interface{}, error) {
+	req := &shhCriteria{}
+	if err := parseParams(params, req); err != nil {
+		return nil, err
+	}
+
+	options, err := req.toFilterOptions()
+	if err != nil {
+		return nil, err
+	}
+	return api.whisper.NewMessageFilter(options)
+}
+
+func (api *shhAPI) subscribe(conn *rpcConnection, params json.RawMessage) (interface{}, error) {
+	var subscriptionType string
+	req := &shhCriteria{}
+	if err := parseParams(params, &subscriptionType, req); err != nil {
+		return nil, err
+	}
+
+	if subscriptionType != "messages" {
+		return nil, &invalidParamsError{message: "unsupported subscription type " + subscriptionType}
+	}
+
+	options, err := req.toFilterOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	sub, err := api.whisper.Subscribe(options)
+	if err != nil {
+		return nil, err
+	}
+	conn.addSubscription(sub.ID, sub.Unsubscribe)
+
+	// push messages until unsubscribed
+	go func() {
+		for {
+			select {
+			case msg, ok := <-sub.Messages():
+				if !ok {
+					return
+				}
+				conn.notify("shh_subscription", sub.ID, convertReceivedMessage(msg))
+
+			case err, ok := <-sub.Err():
+				if !ok {
+					return
+				}
+				// the client must know that some messages were lost
+				conn.notifyError("shh_subscription", sub.ID, err)
+			}
+		}
+	}()
+
+	return sub.ID, nil
+}
+
+func (api *shhAPI) unsubscribe(conn *rpcConnection, params json.RawMessage) (interface{}, error) {
+	id, err := parseStringParam(params)
+	if err != nil {
+		return nil, err
+	}
+	return conn.removeSubscription(id), nil
+}
+
+func (api *shhAPI) getFilterMessages(params json.RawMessage) (interface{}, error) {
+	id, err := parseStringParam(params)
+	if err != nil {
+		return nil, err
+	}
+
+	receivedMessages, err := api.whisper.GetFilterMessages(id)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]*shhMessage, 0, len(receivedMessages))
+	for _, msg := range receivedMessages {
+		messages = append(messages, convertReceivedMessage(msg))
+	}
+	return messages, nil
+}
+
+func (api *shhAPI) deleteMessageFilter(params json.RawMessage) (interface{}, error) {
+	id, err := parseStringParam(params)
+	if err != nil {
+		return nil, err
+	}
+	return true, api.whisper.DeleteMessageFilter(id)
+}
+
+func (api *shhAPI) getBannedPeers(params json.RawMessage) (interface{}, error) {
+	if err := parseParams(params); err != nil {
+		return nil, err
+	}
+
+	bannedPeers := api.whisper.GetBannedPeers()
+	peers := make([]*shhBannedPeer, 0, len(bannedPeers))
+	for _, peer := range bannedPeers {
+		peers = append(peers, &shhBannedPeer{Address: peer.Address, BannedUntil: peer.BannedUntil.Unix()})
+	}
+	return peers, nil
+}
+
+func (api *shhAPI) unbanPeer(params json.RawMessage) (interface{}, error) {
+	peer, err := parseStringParam(params)
+	if err != nil {
+		return nil, err
+	}
+	return true, api.whisper.UnbanPeer(peer)
+}
+
+func (api *shhAPI) getRateLimits(params json.RawMessage) (interface{}, error) {
+	if err := parseParams(params); err != nil {
+		return nil, err
+	}
+	limits := api.whisper.GetRateLimits()
+	return shhRateLimits(limits), nil
+}
+
+func (api *shhAPI) setRateLimits(params json.RawMessage) (interface{}, error) {
+	req := &shhRateLimits{}
+	if err := parseParams(params, req); err != nil {
+		return nil, err
+	}
+	return true, api.whisper.SetRateLimits(whisper.RateLimits(*req))
+}
+
+// convert the criteria to filter options
+func (req *shhCriteria) toFilterOptions() (whisper.FilterOptions, error) {
+	topics := make([]whisper.Topic, 0, len(req.Topics))
+	for _, topic := range req.Topics {
+		if len(topic) != whisper.TopicLength {
+			return whisper.FilterOptions{}, &invalidParamsError{message: fmt.Sprintf("topic must be %d bytes", whisper.TopicLength)}
+		}
+		topics = append(topics, whisper.ConvertBytesToTopic(topic))
+	}
+
+	return whisper.FilterOptions{
+		SymKeyID:     req.SymKeyID,
+		PrivateKeyID: req.PrivateKeyID,
+		MinPow:       req.MinPow,
+		Topics:       topics,
+	}, nil
+}
+
+// convert a received message to its json representation
+func convertReceivedMessage(msg *whisper.ReceivedMessage) *shhMessage {
+	message := &shhMessage{
+		TTL:       msg.TTL,
+		Timestamp: msg.Sent,
+		Topic:     hexBytes(msg.Topic[:]),
+		Payload:   hexBytes(msg.Payload),
+		Padding:   hexBytes(msg.Padding),
+		Pow:       msg.Pow,
+		Hash:      hexBytes(msg.EnvelopeHash[:]),
+	}
+	if msg.Src != nil {
+		message.Sig = hexBytes(msg.Src.Bytes(false))
+	}
+	if msg.Dst != nil {
+		message.Dst = hexBytes(msg.Dst.Bytes(false))
+	}
+	return message
+}
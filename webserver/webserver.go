@@ -12,18 +12,21 @@ import (
 	"github.com/mikanikos/Peerster/client/clientsender"
 	"github.com/mikanikos/Peerster/gossiper"
 	"github.com/mikanikos/Peerster/helpers"
+	"github.com/mikanikos/Peerster/whisper"
 )
 
 // Webserver struct
 type Webserver struct {
 	Gossiper *gossiper.Gossiper
+	Whisper  *whisper.Whisper
 	Client   *clientsender.Client
 }
 
-// NewWebserver for gui, has the gossiper instance to get values to display in the ui and a client to communicate values to the gossiper using the standard protocol
-func NewWebserver(uiPort string, gossiper *gossiper.Gossiper) *Webserver {
+// NewWebserver for gui, has the gossiper and whisper instances to get values to display in the ui and a client to communicate values to the gossiper using the standard protocol
+func NewWebserver(uiPort string, gossiper *gossiper.Gossiper, whisper *whisper.Whisper) *Webserver {
 	return &Webserver{
 		Gossiper: gossiper,
+		Whisper:  whisper,
 		Client:   clientsender.NewClient(uiPort),
 	}
 }
@@ -45,6 +48,9 @@ func (webserver *Webserver) Run(portGUI string) {
 	r.HandleFunc("/round", webserver.getRoundHandler).Methods("GET")
 	r.HandleFunc("/bcLogs", webserver.getBCLogsHandler).Methods("GET")
 	r.HandleFunc("/blockchain", webserver.getBlockchainHandler).Methods("GET")
+	r.HandleFunc("/routes", webserver.getRoutesHandler).Methods("GET")
+	r.HandleFunc("/peerStats", webserver.getPeerStatsHandler).Methods("GET")
+	r.HandleFunc("/whisperPeers", webserver.getWhisperPeersHandler).Methods("GET")
 
 	r.PathPrefix("/").Handler(http.StripPrefix("/", http.FileServer(http.Dir("./webserver"))))
 
@@ -154,3 +160,18 @@ func (webserver *Webserver) getIDHandler(w http.ResponseWriter, r *http.Request)
 func (webserver *Webserver) getOriginHandler(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, webserver.Gossiper.GetOrigins())
 }
+
+// get and display the route to every origin
+func (webserver *Webserver) getRoutesHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, webserver.Gossiper.GetRoutingTable())
+}
+
+// get and display the gossip peers with their traffic counters
+func (webserver *Webserver) getPeerStatsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, webserver.Gossiper.GetPeerStatistics())
+}
+
+// get and display the status of the whisper peers
+func (webserver *Webserver) getWhisperPeersHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, webserver.Whisper.GetPeerStatus())
+}
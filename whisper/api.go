@@ -3,77 +3,109 @@
 package whisper
 
 import (
+	"context"
 	"fmt"
 	ecies "github.com/ecies/go"
+	"math"
 )
 
 // NewMessage contain all the fields to create a whisper message
 type NewMessage struct {
 	SymKeyID  string
 	PublicKey []byte
+	Sig       string
 	TTL       uint32
 	Topic     Topic
 	PowTime   uint32
+	PowTarget float64
 	Payload   []byte
+	Padding   []byte
 }
 
 // NewWhisperMessage create new whisper message and send it to its peers
 func (whisper *Whisper) NewWhisperMessage(message NewMessage) ([]byte, error) {
+	hash, _, err := whisper.PostMessage(context.Background(), message)
+	return hash, err
+}
+
+// PostMessage creates new whisper message and sends it to its peers, mining can be cancelled with the context.
+// It returns the hash of the (first) envelope and the (lowest) pow achieved
+func (whisper *Whisper) PostMessage(ctx context.Context, message NewMessage) ([]byte, float64, error) {
 
 	isSymKey := len(message.SymKeyID) > 0
 	isPubKey := len(message.PublicKey) > 0
 
 	// either symmetric or asymmetric key
 	if isSymKey && isPubKey {
-		return nil, fmt.Errorf("specifiy either public or symmetric key")
+		return nil, 0, fmt.Errorf("specifiy either public or symmetric key")
 	}
 
 	params := &MessageParams{
-		TTL:     message.TTL,
-		Payload: message.Payload,
-		PowTime: message.PowTime,
-		Topic:   message.Topic,
+		TTL:       message.TTL,
+		Payload:   message.Payload,
+		Padding:   message.Padding,
+		PowTime:   message.PowTime,
+		PowTarget: message.PowTarget,
+		Topic:     message.Topic,
+	}
+
+	// without any pow requirement, mine enough to be accepted by me and by all the peers
+	if params.PowTime == 0 && params.PowTarget <= 0 {
+		params.PowTarget = math.Max(whisper.GetMinPow(), whisper.routingHandler.getMaxPeerPow())
 	}
 
 	// check crypt keys
 	if isSymKey {
 		if params.Topic == (Topic{}) {
-			return nil, fmt.Errorf("need topic with symmetric key")
+			return nil, 0, fmt.Errorf("need topic with symmetric key")
 		}
 		key, err := whisper.GetSymKeyFromID(message.SymKeyID)
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
 		params.KeySym = key
 
 		if len(params.KeySym) != aesKeyLength {
-			return nil, fmt.Errorf("invalid key length")
+			return nil, 0, fmt.Errorf("invalid key length")
 		}
 	}
 
 	if isPubKey {
 		key, err := ecies.NewPublicKeyFromBytes(message.PublicKey)
 		if err != nil {
-			return nil, fmt.Errorf("invalid public key")
+			return nil, 0, fmt.Errorf("invalid public key")
 		}
 		params.Dst = key
 	}
 
-	// encrypt and create envelope
-	var result []byte
-	env, err := params.GetEnvelopeFromMessage()
+	// sign with the key pair given, if any
+	if len(message.Sig) > 0 {
+		key, err := whisper.GetPrivateKey(message.Sig)
+		if err != nil {
+			return nil, 0, err
+		}
+		params.Src = key
+	}
+
+	// sign, encrypt and create envelopes, more than one if the payload is big
+	envelopes, err := whisper.createEnvelopes(ctx, params)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
-	err = whisper.SendEnvelope(env)
-	if err == nil {
-		fmt.Println("\nWhisper: sent whisper envelope")
-		hash := env.GetHash()
-		result = hash[:]
+	pow := math.Inf(1)
+	for _, env := range envelopes {
+		err = whisper.SendEnvelope(env)
+		if err != nil {
+			return nil, 0, err
+		}
+		pow = math.Min(pow, env.GetPow())
 	}
 
-	return result, err
+	fmt.Println("\nWhisper: sent whisper envelope")
+	hash := envelopes[0].GetHash()
+
+	return hash[:], pow, nil
 }
 
 // FilterOptions holds various filter options for messages
@@ -100,8 +132,50 @@ func (whisper *Whisper) GetFilterMessages(id string) ([]*ReceivedMessage, error)
 	return messages, nil
 }
 
-// NewMessageFilter creates a new filter
+// DeleteMessageFilter removes the filter with the id given and stops advertising interest in topics no longer needed
+func (whisper *Whisper) DeleteMessageFilter(id string) error {
+	if !whisper.filters.RemoveFilter(id) {
+		return fmt.Errorf("filter not found")
+	}
+	whisper.recomputeBloomFilter()
+	whisper.updateTopicInterest()
+	return nil
+}
+
+// NewMessageFilter creates a new filter, messages are stored until retrieved with GetFilterMessages
 func (whisper *Whisper) NewMessageFilter(req FilterOptions) (string, error) {
+	f, err := whisper.createFilter(req)
+	if err != nil {
+		return "", err
+	}
+	return whisper.addFilter(f)
+}
+
+// Subscribe creates a new filter whose messages are pushed on the subscription as soon as they arrive
+func (whisper *Whisper) Subscribe(req FilterOptions) (*Subscription, error) {
+	f, err := whisper.createFilter(req)
+	if err != nil {
+		return nil, err
+	}
+
+	sub := newSubscription()
+	f.Subscription = sub
+
+	id, err := whisper.addFilter(f)
+	if err != nil {
+		return nil, err
+	}
+
+	sub.ID = id
+	sub.unsubscribe = func() {
+		whisper.DeleteMessageFilter(id)
+	}
+
+	return sub, nil
+}
+
+// createFilter creates a filter from the options given
+func (whisper *Whisper) createFilter(req FilterOptions) (*Filter, error) {
 
 	filter := &Filter{}
 
@@ -110,24 +184,24 @@ func (whisper *Whisper) NewMessageFilter(req FilterOptions) (string, error) {
 
 	// either symmetric or asymmetric key
 	if isSymKey && isPrivKey {
-		return "", fmt.Errorf("either private or symmetric key")
+		return nil, fmt.Errorf("either private or symmetric key")
 	}
 
 	if isSymKey {
 		key, err := whisper.GetSymKeyFromID(req.SymKeyID)
 		if err != nil {
-			return "", fmt.Errorf("no symmetric key found")
+			return nil, fmt.Errorf("no symmetric key found")
 		}
 		filter.KeySym = key
 		if len(key) != aesKeyLength {
-			return "", fmt.Errorf("invalid key length")
+			return nil, fmt.Errorf("invalid key length")
 		}
 	}
 
 	if isPrivKey {
 		key, err := whisper.GetPrivateKey(req.PrivateKeyID)
 		if err != nil {
-			return "", fmt.Errorf("no private key")
+			return nil, fmt.Errorf("no private key")
 		}
 		filter.KeyAsym = key
 	}
@@ -144,13 +218,19 @@ func (whisper *Whisper) NewMessageFilter(req FilterOptions) (string, error) {
 		KeySym:   filter.KeySym,
 		KeyAsym:  filter.KeyAsym,
 		Topics:   topics,
-		Pow: 	req.MinPow,
+		Pow:      req.MinPow,
 		Messages: make(map[[32]byte]*ReceivedMessage),
 	}
 
+	return f, nil
+}
+
+// addFilter adds the filter to the storage and updates the bloom filter
+func (whisper *Whisper) addFilter(f *Filter) (string, error) {
 	s, err := whisper.filters.AddFilter(f)
 	if err == nil {
 		whisper.updateBloomFilter(f)
+		whisper.updateTopicInterest()
 	}
 
 	fmt.Println("\nWhisper: created new filter with id = " + s)
@@ -49,3 +49,12 @@ func GetEmptyBloomFilter() []byte {
 	}
 	return bloom
 }
+
+// GetFullBloomFilter returns a bloom filter matching every topic
+func GetFullBloomFilter() []byte {
+	bloom := make([]byte, BloomFilterSize)
+	for i := 0; i < BloomFilterSize; i++ {
+		bloom[i] = 255
+	}
+	return bloom
+}
@@ -12,25 +12,112 @@ const (
 	messagesCode       = 1
 	powRequirementCode = 2
 	bloomFilterExCode  = 3
+	maxMsgSizeCode     = 4
+	topicInterestCode  = 5
+	inventoryCode      = 6
+	getEnvelopesCode   = 7
+	p2pRequestCode     = 126
+	p2pMessageCode     = 127
 
 	// lengths in bytes
-	TopicLength     = 4
-	aesKeyLength    = 32
-	keyIDSize       = 32
-	BloomFilterSize = 64
+	TopicLength       = 4
+	aesKeyLength      = 32
+	keyIDSize         = 32
+	BloomFilterSize   = 64
+	flagsLength       = 1
+	payloadSizeLength = 4
+	privateKeyLength  = 32
+	publicKeyLength   = 65
+	signatureLength   = 64
+
+	// flags of the message payload
+	signatureFlag = byte(4)
+	partFlag      = byte(8)
+
+	// big payloads are split in parts of this size, each one in its own envelope
+	partIDLength     = 16
+	partHeaderLength = partIDLength + 2 + 2
+	maxPartSize      = 48 * 1024
+	maxMessageParts  = 1024
+	// messages being reassembled by a filter and bytes of their parts
+	maxPendingMessages  = 16
+	maxPendingPartBytes = 2 * int(MaxMessageSize)
 
 	MaxMessageSize        = uint32(10 * 1024 * 1024)
 	DefaultMaxMessageSize = uint32(1024 * 1024)
 	DefaultMinimumPoW     = 0.2
 	DefaultTTL            = 60
 	DefaultSyncAllowance  = 10
+	DefaultMaxPowTime     = 60
 
 	padSizeLimit      = 256
 	messageQueueLimit = 1024
 
+	subscriptionBufferSize = 1024
+
+	// envelope hashes announced or requested in a single packet
+	maxInventoryBatch = 1000
+	// a missing envelope is requested again, to the next peer that announced it, after this time and a few times at most
+	inventoryRequestTimeout = time.Second
+	maxRequestAttempts      = 5
+	// peers remembered as announcers of a missing envelope
+	maxRequestAnnouncers = 8
+	// envelopes announced by peers are remembered for this time
+	inventoryExpiration = DefaultTTL * time.Second
+	// an envelope is announced again to a peer that didn't announce, request or receive it, a few times at most
+	inventoryAnnounceTimeout = 5 * time.Second
+	maxAnnouncements         = 3
+	// envelope hashes remembered for each peer
+	maxInventoryPerPeer = 10 * maxInventoryBatch
+	// envelopes and bytes sent for a single request
+	maxRequestedEnvelopes = 64
+	maxRequestedBytes     = int(DefaultMaxMessageSize)
+
+	// mail server: envelopes and bytes sent for a single request, time between two requests of a peer, archive retention and size
+	maxMailEnvelopes     = 256
+	maxMailBytes         = 1024 * 1024
+	mailRequestInterval  = 10 * time.Second
+	DefaultMailRetention = 30 * 24 * time.Hour
+	archivePruneTimer    = time.Hour
+	maxArchiveBytes      = int64(1024 * 1024 * 1024)
+	// direct envelopes of a mail server are accepted for this time after the request
+	mailReplyTimeout = 10 * time.Second
+
+	// above this number of topics only the bloom filter is advertised
+	maxTopicInterest = 10000
+
+	// symmetric key derivation from password
+	symKeySalt       = "whisper symmetric key"
+	pbkdf2Iterations = 65356
+
+	// key store encryption parameters, the passphrase is read from the environment if no file is given
+	passphraseEnv      = "WHISPER_PASSPHRASE"
+	keyStoreSaltLength = 32
+	scryptN            = 1 << 15
+	scryptR            = 8
+	scryptP            = 1
+
 	expirationTimer = 10 * time.Second
 	broadcastTimer  = time.Second
 	statusTimer     = 10 * time.Second
+
+	// peers that miss this many status heartbeats are removed from the routing table
+	statusExpiration = 3 * statusTimer
+
+	// peer reputation: score to reach for a ban, half life of the score and ban durations
+	banThreshold   = 100.0
+	scoreHalfLife  = 5 * time.Minute
+	banDuration    = 10 * time.Minute
+	maxBanDuration = 24 * time.Hour
+	banMemory      = 24 * time.Hour
+
+	// default rate limits of incoming packets, per second
+	DefaultPeerEnvelopesRate   = 100.0
+	DefaultPeerBytesRate       = float64(DefaultMaxMessageSize)
+	DefaultIPEnvelopesRate     = 200.0
+	DefaultIPBytesRate         = float64(2 * DefaultMaxMessageSize)
+	DefaultGlobalEnvelopesRate = 1000.0
+	DefaultGlobalBytesRate     = float64(MaxMessageSize)
 )
 
 const (
@@ -39,4 +126,7 @@ const (
 	minPowToleranceIdx
 	bloomFilterIdx
 	bloomFilterToleranceIdx
+	bloomFilterSetIdx
+	maxMsgSizeToleranceIdx
+	topicInterestIdx
 )
@@ -3,44 +3,58 @@
 package whisper
 
 import (
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	ecies "github.com/ecies/go"
+	"golang.org/x/crypto/pbkdf2"
 )
 
-// NewKeyPair generates secp256k1 key pair and store them
-func (whisper *Whisper) NewKeyPair() (string, error) {
-	key, err := ecies.GenerateKey()
+// storeKey stores the key under a new unique id and persists it if the key store is open
+func (whisper *Whisper) storeKey(key interface{}) (string, error) {
 	id, err := generateRandomID()
 	if err != nil {
 		return "", err
 	}
 
-	fmt.Println(hex.EncodeToString(key.Bytes()))
-
 	if _, loaded := whisper.cryptoKeys.LoadOrStore(id, key); loaded {
 		return "", fmt.Errorf("failed to generate unique ID")
 	}
-	return id, nil
-}
 
-// DeleteKey deletes the specified key with an id
-func (whisper *Whisper) DeleteKey(id string) {
-	whisper.cryptoKeys.Delete(id)
+	if whisper.keyStore != nil {
+		err = whisper.keyStore.saveKey(id, key)
+		if err != nil {
+			whisper.cryptoKeys.Delete(id)
+			return "", err
+		}
+	}
+
+	return id, nil
 }
 
-// AddKeyPair imports an asymmetric private key and returns its id
-func (whisper *Whisper) AddKeyPair(key *ecies.PrivateKey) (string, error) {
-	id, err := generateRandomID()
+// NewKeyPair generates secp256k1 key pair and store them
+func (whisper *Whisper) NewKeyPair() (string, error) {
+	key, err := ecies.GenerateKey()
 	if err != nil {
 		return "", err
 	}
+	return whisper.storeKey(key)
+}
 
-	if _, loaded := whisper.cryptoKeys.LoadOrStore(id, key); loaded {
-		return "", fmt.Errorf("failed to generate unique ID")
+// DeleteKey deletes the specified key with an id, from the key store too
+func (whisper *Whisper) DeleteKey(id string) {
+	whisper.cryptoKeys.Delete(id)
+	if whisper.keyStore != nil {
+		err := whisper.keyStore.deleteKey(id)
+		if err != nil {
+			fmt.Println(err)
+		}
 	}
+}
 
-	return id, nil
+// AddKeyPair imports an asymmetric private key and returns its id
+func (whisper *Whisper) AddKeyPair(key *ecies.PrivateKey) (string, error) {
+	return whisper.storeKey(key)
 }
 
 // HasKey checks if a key is present in the storage
@@ -53,7 +67,9 @@ func (whisper *Whisper) HasKey(id string) bool {
 func (whisper *Whisper) GetPrivateKey(id string) (*ecies.PrivateKey, error) {
 	value, loaded := whisper.cryptoKeys.Load(id)
 	if loaded {
-		return value.(*ecies.PrivateKey), nil
+		if key, ok := value.(*ecies.PrivateKey); ok {
+			return key, nil
+		}
 	}
 	return nil, fmt.Errorf("no private key for id given")
 }
@@ -64,18 +80,16 @@ func (whisper *Whisper) GenerateSymKey() (string, error) {
 	if err != nil {
 		return "", err
 	}
+	return whisper.storeKey(key)
+}
 
-	id, err := generateRandomID()
-	if err != nil {
-		return "", err
-	}
-
-
-	fmt.Println(hex.EncodeToString(key))
-	if _, loaded := whisper.cryptoKeys.LoadOrStore(id, key); loaded {
-		return "", fmt.Errorf("failed to generate unique ID")
+// GenerateSymKeyFromPassword derives the symmetric key from the password and stores it under id, same password gives same key on every node
+func (whisper *Whisper) GenerateSymKeyFromPassword(password string) (string, error) {
+	if len(password) == 0 {
+		return "", fmt.Errorf("empty password")
 	}
-	return id, nil
+	key := pbkdf2.Key([]byte(password), []byte(symKeySalt), pbkdf2Iterations, aesKeyLength, sha256.New)
+	return whisper.storeKey(key)
 }
 
 // AddSymKey stores a symmetric key returns its id
@@ -84,29 +98,25 @@ func (whisper *Whisper) AddSymKey(k string) (string, error) {
 	if len(key) != aesKeyLength {
 		return "", fmt.Errorf("wrong key GetSize")
 	}
-
-	id, err := generateRandomID()
-	if err != nil {
-		return "", err
-	}
-
-	if _, loaded := whisper.cryptoKeys.LoadOrStore(id, key); loaded {
-		return "", fmt.Errorf("failed to generate unique ID")
-	}
-	return id, nil
+	return whisper.storeKey(key)
 }
 
 // GetSymKeyFromID returns the symmetric key given its id
 func (whisper *Whisper) GetSymKeyFromID(id string) ([]byte, error) {
 	value, loaded := whisper.cryptoKeys.Load(id)
 	if loaded {
-		return value.([]byte), nil
+		if key, ok := value.([]byte); ok {
+			return key, nil
+		}
 	}
 	return nil, fmt.Errorf("no sym key for id given")
 }
 
 // AddPrivateKey adds the given private key
 func (whisper *Whisper) AddPrivateKey(privateKey []byte) (string, error) {
+	if len(privateKey) != privateKeyLength {
+		return "", fmt.Errorf("invalid private key length")
+	}
 	key := ecies.NewPrivateKeyFromBytes(privateKey)
 	return whisper.AddKeyPair(key)
 }
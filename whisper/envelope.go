@@ -59,7 +59,7 @@ func (e *Envelope) GetHash() [32]byte {
 	return sha3.Sum256(encoded)
 }
 
-// GetMessageFromEnvelope decrypts the message payload of the envelope
+// GetMessageFromEnvelope decrypts the message payload of the envelope and verifies its signature
 func (e *Envelope) GetMessageFromEnvelope(subscriber *Filter) *ReceivedMessage {
 	if subscriber == nil {
 		return nil
@@ -67,31 +67,34 @@ func (e *Envelope) GetMessageFromEnvelope(subscriber *Filter) *ReceivedMessage {
 
 	msg := &ReceivedMessage{}
 
+	var raw []byte
+	var err error
+
 	if subscriber.KeyAsym != nil {
-		decrypted, err := decryptWithPrivateKey(e.Data, subscriber.KeyAsym)
-		msg.Payload = decrypted
+		raw, err = decryptWithPrivateKey(e.Data, subscriber.KeyAsym)
 		if err != nil {
 			return nil
 		}
-		if decrypted != nil {
-			msg.Dst = subscriber.KeyAsym.PublicKey
-		}
+		msg.Dst = subscriber.KeyAsym.PublicKey
 	} else if subscriber.KeySym != nil {
-		decrypted, err := decryptWithSymmetricKey(e.Data, subscriber.KeySym)
-		msg.Payload = decrypted
+		raw, err = decryptWithSymmetricKey(e.Data, subscriber.KeySym)
 		if err != nil {
 			return nil
 		}
-		if decrypted != nil {
-			msg.SymKeyHash = sha3.Sum256(subscriber.KeySym)
-		}
+		msg.SymKeyHash = sha3.Sum256(subscriber.KeySym)
 	} else {
-		msg.Payload = e.Data
+		raw = e.Data
+	}
+
+	// drop messages with malformed payload or forged signature
+	if err = msg.parseRawPayload(raw); err != nil {
+		return nil
 	}
 
 	msg.Topic = e.Topic
 	msg.TTL = e.TTL
 	msg.Sent = e.Expiry - e.TTL
+	msg.Pow = e.GetPow()
 	msg.EnvelopeHash = e.GetHash()
 
 	return msg
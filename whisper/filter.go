@@ -3,8 +3,10 @@
 package whisper
 
 import (
+	"bytes"
 	"fmt"
 	ecies "github.com/ecies/go"
+	"sort"
 	"sync"
 )
 
@@ -17,6 +19,13 @@ type Filter struct {
 
 	Messages map[[32]byte]*ReceivedMessage
 	Mutex    sync.RWMutex
+
+	// if set, messages are pushed instead of stored
+	Subscription *Subscription
+
+	// parts of big messages not complete yet and their bytes
+	parts     map[string]*partialMessage
+	partsSize int
 }
 
 // FilterStorage stores all the filters created
@@ -77,14 +86,47 @@ func (fs *FilterStorage) RemoveFilter(id string) bool {
 	sub, loaded := fs.subscribers[id]
 	if loaded {
 		delete(fs.subscribers, id)
-		for _, topic := range sub.Topics {
-			delete(fs.topicToFilters[ConvertBytesToTopic(topic)], sub)
+		for _, t := range sub.Topics {
+			topic := ConvertBytesToTopic(t)
+			delete(fs.topicToFilters[topic], sub)
+			if len(fs.topicToFilters[topic]) == 0 {
+				delete(fs.topicToFilters, topic)
+			}
 		}
 		return true
 	}
 	return false
 }
 
+// getAggregatedBloom returns the bloom filter matching the topics of all the stored filters
+func (fs *FilterStorage) getAggregatedBloom() []byte {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+
+	aggregate := GetEmptyBloomFilter()
+	for topic := range fs.topicToFilters {
+		aggregate = AggregateBloom(aggregate, ConvertTopicToBloom(topic))
+	}
+	return aggregate
+}
+
+// getTopics returns the topics of all the stored filters, sorted
+func (fs *FilterStorage) getTopics() []Topic {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+
+	topics := make([]Topic, 0, len(fs.topicToFilters))
+	for topic := range fs.topicToFilters {
+		topics = append(topics, topic)
+	}
+
+	sort.Slice(topics, func(i, j int) bool {
+		return bytes.Compare(topics[i][:], topics[j][:]) < 0
+	})
+
+	return topics
+}
+
 // getSubscribersByTopic returns all filters given a topic
 func (fs *FilterStorage) getSubscribersByTopic(topic Topic) []*Filter {
 	res := make([]*Filter, 0, len(fs.topicToFilters[topic]))
@@ -112,15 +154,26 @@ func (fs *FilterStorage) NotifySubscribers(env *Envelope) {
 	for _, sub := range candidates {
 		if sub.Pow <= 0 || env.pow >= sub.Pow {
 			msg = env.GetMessageFromEnvelope(sub)
+			if msg != nil && msg.partCount > 1 {
+				// deliver only once all the parts arrived
+				msg = sub.addPart(msg)
+				if msg == nil {
+					continue
+				}
+			}
 			if msg == nil {
 				fmt.Println("\nWhisper: failed to open message")
 			} else {
 				fmt.Println("\nWhisper: unwrapped and decrypted payload, new message for client is available")
-				sub.Mutex.Lock()
-				if _, exist := sub.Messages[msg.EnvelopeHash]; !exist {
-					sub.Messages[msg.EnvelopeHash] = msg
+				if sub.Subscription != nil {
+					sub.Subscription.deliver(msg)
+				} else {
+					sub.Mutex.Lock()
+					if _, exist := sub.Messages[msg.EnvelopeHash]; !exist {
+						sub.Messages[msg.EnvelopeHash] = msg
+					}
+					sub.Mutex.Unlock()
 				}
-				sub.Mutex.Unlock()
 			}
 		}
 	}
@@ -0,0 +1,403 @@
+/* Contributors: Andrea Piccione */
+
+package whisper
+
+import (
+	"fmt"
+	"github.com/dedis/protobuf"
+	"github.com/mikanikos/DSignal/gossiper"
+	"net"
+	"sync"
+	"time"
+)
+
+// Inventory is a batch of envelope hashes, either announced or requested
+type Inventory struct {
+	Hashes [][]byte
+}
+
+// announcement of an envelope to a peer
+type announcement struct {
+	last  time.Time
+	count int
+}
+
+// request of a missing envelope, sent in turn to the peers that announced it
+type request struct {
+	peer       string
+	last       time.Time
+	attempts   int
+	announcers []string
+}
+
+// InventoryHandler tracks the envelopes each peer is known to have, the ones announced to peers and the ones requested to peers
+type InventoryHandler struct {
+	// peer -> envelope hash -> time after which it can be forgotten
+	known map[string]map[[32]byte]uint32
+	// peer -> envelope hash -> last announcement, until the peer is known to have it
+	announced map[string]map[[32]byte]*announcement
+	// envelope hash -> pending request, until the envelope is received
+	requested map[[32]byte]*request
+	mutex     sync.Mutex
+}
+
+// NewInventoryHandler create new inventory handler
+func NewInventoryHandler() *InventoryHandler {
+	return &InventoryHandler{
+		known:     make(map[string]map[[32]byte]uint32),
+		announced: make(map[string]map[[32]byte]*announcement),
+		requested: make(map[[32]byte]*request),
+	}
+}
+
+// markKnown records that the peer has the envelope, it returns true if it was not known before
+func (inventoryHandler *InventoryHandler) markKnown(peer string, hash [32]byte, expiry uint32) bool {
+	inventoryHandler.mutex.Lock()
+	defer inventoryHandler.mutex.Unlock()
+
+	return inventoryHandler.markKnownUnsafe(peer, hash, expiry)
+}
+
+// markKnownUnsafe records that the peer has the envelope, without locking. Hashes beyond maxInventoryPerPeer are not recorded
+func (inventoryHandler *InventoryHandler) markKnownUnsafe(peer string, hash [32]byte, expiry uint32) bool {
+	delete(inventoryHandler.announced[peer], hash)
+
+	hashes, loaded := inventoryHandler.known[peer]
+	if !loaded {
+		hashes = make(map[[32]byte]uint32)
+		inventoryHandler.known[peer] = hashes
+	}
+
+	_, loaded = hashes[hash]
+	if !loaded && len(hashes) >= maxInventoryPerPeer {
+		return false
+	}
+	if !loaded || hashes[hash] < expiry {
+		hashes[hash] = expiry
+	}
+	return !loaded
+}
+
+// shouldAnnounce checks if the envelope is not known by the peer and it's time to announce it (again), in that case it marks it as announced
+func (inventoryHandler *InventoryHandler) shouldAnnounce(peer string, hash [32]byte) bool {
+	inventoryHandler.mutex.Lock()
+	defer inventoryHandler.mutex.Unlock()
+
+	if _, known := inventoryHandler.known[peer][hash]; known {
+		return false
+	}
+
+	announcements, loaded := inventoryHandler.announced[peer]
+	if !loaded {
+		announcements = make(map[[32]byte]*announcement)
+		inventoryHandler.announced[peer] = announcements
+	}
+
+	ann, loaded := announcements[hash]
+	if !loaded {
+		announcements[hash] = &announcement{last: time.Now(), count: 1}
+		return true
+	}
+
+	if ann.count >= maxAnnouncements || time.Since(ann.last) < inventoryAnnounceTimeout {
+		return false
+	}
+	ann.last = time.Now()
+	ann.count++
+	return true
+}
+
+// envelopeReceived records that the peer sent the envelope, so it's not pending anymore
+func (inventoryHandler *InventoryHandler) envelopeReceived(peer string, hash [32]byte, expiry uint32) {
+	inventoryHandler.mutex.Lock()
+	defer inventoryHandler.mutex.Unlock()
+
+	inventoryHandler.markKnownUnsafe(peer, hash, expiry)
+	delete(inventoryHandler.requested, hash)
+}
+
+// shouldRequest records the peer as one that announced the missing envelope and checks if it's not requested yet,
+// in that case it marks it as requested to the peer
+func (inventoryHandler *InventoryHandler) shouldRequest(peer string, hash [32]byte) bool {
+	inventoryHandler.mutex.Lock()
+	defer inventoryHandler.mutex.Unlock()
+
+	req, loaded := inventoryHandler.requested[hash]
+	if !loaded {
+		inventoryHandler.requested[hash] = &request{peer: peer, last: time.Now(), attempts: 1, announcers: []string{peer}}
+		return true
+	}
+
+	if !containsPeer(req.announcers, peer) && len(req.announcers) < maxRequestAnnouncers {
+		req.announcers = append(req.announcers, peer)
+	}
+	return false
+}
+
+// requestsToRetry returns, for each peer, the missing envelopes to request again because the last request was not answered in time:
+// each one is requested to the next peer that announced it, until maxRequestAttempts
+func (inventoryHandler *InventoryHandler) requestsToRetry() map[string][][]byte {
+	inventoryHandler.mutex.Lock()
+	defer inventoryHandler.mutex.Unlock()
+
+	retries := make(map[string][][]byte)
+	for hash, req := range inventoryHandler.requested {
+		if time.Since(req.last) < inventoryRequestTimeout {
+			continue
+		}
+		if req.attempts >= maxRequestAttempts || len(req.announcers) == 0 {
+			delete(inventoryHandler.requested, hash)
+			continue
+		}
+
+		next := 0
+		for i, announcer := range req.announcers {
+			if announcer == req.peer {
+				next = (i + 1) % len(req.announcers)
+				break
+			}
+		}
+		req.peer = req.announcers[next]
+		req.last = time.Now()
+		req.attempts++
+
+		missingHash := hash
+		retries[req.peer] = append(retries[req.peer], missingHash[:])
+	}
+	return retries
+}
+
+// removeExpiredInventory forgets expired hashes and old announcements
+func (inventoryHandler *InventoryHandler) removeExpiredInventory() {
+	inventoryHandler.mutex.Lock()
+	defer inventoryHandler.mutex.Unlock()
+
+	now := uint32(time.Now().Unix())
+	for peer, hashes := range inventoryHandler.known {
+		for hash, expiry := range hashes {
+			if expiry < now {
+				delete(hashes, hash)
+			}
+		}
+		if len(hashes) == 0 {
+			delete(inventoryHandler.known, peer)
+		}
+	}
+
+	for peer, announcements := range inventoryHandler.announced {
+		for hash, ann := range announcements {
+			if time.Since(ann.last) > inventoryExpiration {
+				delete(announcements, hash)
+			}
+		}
+		if len(announcements) == 0 {
+			delete(inventoryHandler.announced, peer)
+		}
+	}
+}
+
+// removePeer forgets the envelopes known by the peer, the envelopes requested to it are requested to another peer as soon as possible
+func (inventoryHandler *InventoryHandler) removePeer(peer string) {
+	inventoryHandler.mutex.Lock()
+	defer inventoryHandler.mutex.Unlock()
+
+	delete(inventoryHandler.known, peer)
+	delete(inventoryHandler.announced, peer)
+
+	for hash, req := range inventoryHandler.requested {
+		for i, announcer := range req.announcers {
+			if announcer == peer {
+				req.announcers = append(req.announcers[:i], req.announcers[i+1:]...)
+				break
+			}
+		}
+		if len(req.announcers) == 0 {
+			delete(inventoryHandler.requested, hash)
+		} else if req.peer == peer {
+			req.peer = ""
+			req.last = time.Time{}
+		}
+	}
+}
+
+// containsPeer checks if the peer is in the list
+func containsPeer(peers []string, peer string) bool {
+	for _, p := range peers {
+		if p == peer {
+			return true
+		}
+	}
+	return false
+}
+
+// announceEnvelopes sends to each interested peer the hashes of the envelopes it doesn't know yet,
+// they're announced again until the peer announces, requests or receives them
+func (whisper *Whisper) announceEnvelopes() {
+	envelopes := whisper.Envelopes()
+
+	announcements := make(map[string][][]byte)
+	addresses := make(map[string]*net.UDPAddr)
+
+	whisper.routingHandler.mutex.RLock()
+	for peer := range whisper.routingHandler.peerStatus {
+		// peers not in the gossiper yet are announced the envelopes once they're added
+		if address := whisper.gossiper.GetPeerFromString(peer); address != nil {
+			addresses[peer] = address
+		}
+	}
+
+	for _, envOr := range envelopes {
+		hash := envOr.Envelope.GetHash()
+		for peer, status := range whisper.routingHandler.peerStatus {
+			if _, loaded := addresses[peer]; loaded && peer != envOr.Origin.String() && status.accepts(envOr.Envelope) {
+				if whisper.inventoryHandler.shouldAnnounce(peer, hash) {
+					announcements[peer] = append(announcements[peer], hash[:])
+				}
+			}
+		}
+	}
+	whisper.routingHandler.mutex.RUnlock()
+
+	for peer, hashes := range announcements {
+		whisper.sendInventory(inventoryCode, hashes, addresses[peer])
+	}
+}
+
+// pushEnvelope sends the envelope to the interested peers, it's still announced to them later in case it gets lost
+func (whisper *Whisper) pushEnvelope(envelope *Envelope) {
+	packetToSend, err := protobuf.Encode(envelope)
+	if err != nil {
+		return
+	}
+	packet := &gossiper.GossipPacket{WhisperPacket: &gossiper.WhisperPacket{Code: messagesCode, Payload: packetToSend, Size: uint32(len(packetToSend))}}
+
+	peers := make([]*net.UDPAddr, 0)
+
+	whisper.routingHandler.mutex.RLock()
+	for peer, status := range whisper.routingHandler.peerStatus {
+		address := whisper.gossiper.GetPeerFromString(peer)
+		if address != nil && status.accepts(envelope) {
+			peers = append(peers, address)
+		}
+	}
+	whisper.routingHandler.mutex.RUnlock()
+
+	for _, address := range peers {
+		whisper.gossiper.ConnectionHandler.SendPacket(packet, address)
+	}
+}
+
+// requestMissingEnvelopes requests again the envelopes that didn't arrive in time, to another peer that announced them if any
+func (whisper *Whisper) requestMissingEnvelopes() {
+	for peer, hashes := range whisper.inventoryHandler.requestsToRetry() {
+		address := whisper.gossiper.GetPeerFromString(peer)
+		if address != nil {
+			whisper.sendInventory(getEnvelopesCode, hashes, address)
+		}
+	}
+}
+
+// sendInventory sends the hashes to the peer in batches
+func (whisper *Whisper) sendInventory(code uint32, hashes [][]byte, address *net.UDPAddr) {
+	for len(hashes) > 0 {
+		batchSize := len(hashes)
+		if batchSize > maxInventoryBatch {
+			batchSize = maxInventoryBatch
+		}
+
+		payload, err := protobuf.Encode(&Inventory{Hashes: hashes[:batchSize]})
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+
+		packet := &gossiper.GossipPacket{WhisperPacket: &gossiper.WhisperPacket{Code: code, Payload: payload, Size: uint32(len(payload))}}
+		whisper.gossiper.ConnectionHandler.SendPacket(packet, address)
+
+		hashes = hashes[batchSize:]
+	}
+}
+
+// decodeInventory decodes and validates a batch of hashes from a peer
+func decodeInventory(payload []byte) ([][32]byte, error) {
+	inventory := &Inventory{}
+	err := protobuf.Decode(payload, inventory)
+	if err != nil || len(inventory.Hashes) > maxInventoryBatch {
+		return nil, &envelopeError{violation: undecodableViolation, message: "invalid inventory"}
+	}
+
+	hashes := make([][32]byte, len(inventory.Hashes))
+	for i, hash := range inventory.Hashes {
+		if len(hash) != len(hashes[i]) {
+			return nil, &envelopeError{violation: undecodableViolation, message: "invalid envelope hash"}
+		}
+		copy(hashes[i][:], hash)
+	}
+	return hashes, nil
+}
+
+// handleInventory records the envelopes announced by the peer and requests the missing ones
+func (whisper *Whisper) handleInventory(payload []byte, address *net.UDPAddr) error {
+	hashes, err := decodeInventory(payload)
+	if err != nil {
+		return err
+	}
+
+	expiry := uint32(time.Now().Add(inventoryExpiration).Unix())
+
+	missing := make([][]byte, 0)
+	for _, hash := range hashes {
+		whisper.inventoryHandler.markKnown(address.String(), hash, expiry)
+
+		if whisper.GetEnvelope(hash) == nil && whisper.inventoryHandler.shouldRequest(address.String(), hash) {
+			missingHash := hash
+			missing = append(missing, missingHash[:])
+		}
+	}
+
+	if len(missing) > 0 {
+		whisper.sendInventory(getEnvelopesCode, missing, address)
+	}
+
+	return nil
+}
+
+// handleEnvelopesRequest sends to the peer the envelopes requested, at most maxRequestedEnvelopes and maxRequestedBytes:
+// the ones not sent are announced again later. Only peers of the gossiper are served, so that the reply can't be used to flood other hosts
+func (whisper *Whisper) handleEnvelopesRequest(payload []byte, address *net.UDPAddr) error {
+	hashes, err := decodeInventory(payload)
+	if err != nil {
+		return err
+	}
+
+	if whisper.gossiper.GetPeerFromString(address.String()) == nil {
+		return fmt.Errorf("request from unknown peer")
+	}
+
+	sent, size := 0, 0
+	for _, hash := range hashes {
+		envOr := whisper.GetEnvelope(hash)
+		if envOr == nil {
+			continue
+		}
+
+		packetToSend, err := protobuf.Encode(envOr.Envelope)
+		if err != nil {
+			continue
+		}
+
+		if sent == maxRequestedEnvelopes || size+len(packetToSend) > maxRequestedBytes {
+			break
+		}
+		sent++
+		size += len(packetToSend)
+
+		// the peer has it now
+		whisper.inventoryHandler.markKnown(address.String(), hash, envOr.Envelope.Expiry)
+
+		packet := &gossiper.GossipPacket{WhisperPacket: &gossiper.WhisperPacket{Code: messagesCode, Payload: packetToSend, Size: uint32(len(packetToSend))}}
+		whisper.gossiper.ConnectionHandler.SendPacket(packet, address)
+	}
+
+	return nil
+}
@@ -0,0 +1,299 @@
+/* Contributors: Andrea Piccione */
+
+package whisper
+
+import (
+	"fmt"
+	"github.com/dedis/protobuf"
+	ecies "github.com/ecies/go"
+	"golang.org/x/crypto/scrypt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// EncryptedKey is the on-disk representation of a key, encrypted with a key derived from the passphrase
+type EncryptedKey struct {
+	Symmetric bool
+	Salt      []byte
+	Data      []byte
+}
+
+// KeyInfo describes a key in the key store
+type KeyInfo struct {
+	ID        string
+	Symmetric bool
+	Locked    bool
+}
+
+// KeyStore persists key pairs and symmetric keys in a folder, one file per key id
+type KeyStore struct {
+	folder     string
+	passphrase string
+	mutex      sync.RWMutex
+}
+
+// ReadPassphrase reads the key store passphrase from the file given or, if no file is given, from the WHISPER_PASSPHRASE environment variable
+func ReadPassphrase(file string) (string, error) {
+	passphrase := os.Getenv(passphraseEnv)
+	if file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		passphrase = strings.TrimRight(string(data), "\r\n")
+	}
+
+	if passphrase == "" {
+		return "", fmt.Errorf("empty passphrase")
+	}
+	return passphrase, nil
+}
+
+// NewKeyStore creates a key store in the folder given, new keys are encrypted with the passphrase
+func NewKeyStore(folder, passphrase string) (*KeyStore, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("empty passphrase")
+	}
+	err := os.MkdirAll(folder, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyStore{folder: folder, passphrase: passphrase}, nil
+}
+
+// deriveKey derives the aes key from the passphrase with scrypt
+func deriveKey(passphrase string, salt []byte) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, aesKeyLength)
+}
+
+// get the path of the key file, only ids with the format of the generated ones are accepted
+func (keyStore *KeyStore) getKeyPath(id string) (string, error) {
+	if !isValidKeyID(id) {
+		return "", fmt.Errorf("invalid key id")
+	}
+	return filepath.Join(keyStore.folder, id), nil
+}
+
+// saveKey encrypts the key and writes it on disk under its id
+func (keyStore *KeyStore) saveKey(id string, key interface{}) error {
+	path, err := keyStore.getKeyPath(id)
+	if err != nil {
+		return err
+	}
+
+	encryptedKey := &EncryptedKey{}
+
+	var raw []byte
+	switch k := key.(type) {
+	case *ecies.PrivateKey:
+		raw = k.Bytes()
+	case []byte:
+		raw = k
+		encryptedKey.Symmetric = true
+	default:
+		return fmt.Errorf("unknown key type")
+	}
+
+	salt, err := generateRandomBytes(keyStoreSaltLength)
+	if err != nil {
+		return err
+	}
+	derived, err := deriveKey(keyStore.passphrase, salt)
+	if err != nil {
+		return err
+	}
+	encrypted, err := encryptWithSymmetricKey(raw, derived)
+	if err != nil {
+		return err
+	}
+	encryptedKey.Salt = salt
+	encryptedKey.Data = encrypted
+
+	encoded, err := protobuf.Encode(encryptedKey)
+	if err != nil {
+		return err
+	}
+
+	keyStore.mutex.Lock()
+	defer keyStore.mutex.Unlock()
+
+	return ioutil.WriteFile(path, encoded, 0600)
+}
+
+// readKey reads the encrypted key from disk
+func (keyStore *KeyStore) readKey(id string) (*EncryptedKey, error) {
+	path, err := keyStore.getKeyPath(id)
+	if err != nil {
+		return nil, err
+	}
+
+	keyStore.mutex.RLock()
+	defer keyStore.mutex.RUnlock()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("key not in key store")
+	}
+
+	encryptedKey := &EncryptedKey{}
+	err = protobuf.Decode(data, encryptedKey)
+	if err != nil {
+		return nil, err
+	}
+	return encryptedKey, nil
+}
+
+// loadKey reads the key from disk and decrypts it with the passphrase
+func (keyStore *KeyStore) loadKey(id, passphrase string) (interface{}, error) {
+	encryptedKey, err := keyStore.readKey(id)
+	if err != nil {
+		return nil, err
+	}
+
+	derived, err := deriveKey(passphrase, encryptedKey.Salt)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := decryptWithSymmetricKey(encryptedKey.Data, derived)
+	if err != nil {
+		return nil, fmt.Errorf("wrong passphrase")
+	}
+
+	if encryptedKey.Symmetric {
+		if len(raw) != aesKeyLength {
+			return nil, fmt.Errorf("wrong key GetSize")
+		}
+		return raw, nil
+	}
+	if len(raw) != privateKeyLength {
+		return nil, fmt.Errorf("invalid private key length")
+	}
+	return ecies.NewPrivateKeyFromBytes(raw), nil
+}
+
+// deleteKey removes the key from disk
+func (keyStore *KeyStore) deleteKey(id string) error {
+	path, err := keyStore.getKeyPath(id)
+	if err != nil {
+		return err
+	}
+
+	keyStore.mutex.Lock()
+	defer keyStore.mutex.Unlock()
+
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// getKeyIDs returns the ids of all the keys on disk
+func (keyStore *KeyStore) getKeyIDs() ([]string, error) {
+	keyStore.mutex.RLock()
+	defer keyStore.mutex.RUnlock()
+
+	files, err := ioutil.ReadDir(keyStore.folder)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(files))
+	for _, file := range files {
+		if !file.IsDir() && isValidKeyID(file.Name()) {
+			ids = append(ids, file.Name())
+		}
+	}
+	return ids, nil
+}
+
+// OpenKeyStore persists keys in the folder given, encrypted with the passphrase, and unlocks the keys already stored under their ids
+func (whisper *Whisper) OpenKeyStore(folder, passphrase string) error {
+	keyStore, err := NewKeyStore(folder, passphrase)
+	if err != nil {
+		return err
+	}
+
+	ids, err := keyStore.getKeyIDs()
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		key, err := keyStore.loadKey(id, passphrase)
+		if err != nil {
+			fmt.Println("\nWhisper: key " + id + " stays locked, " + err.Error())
+			continue
+		}
+		whisper.cryptoKeys.Store(id, key)
+	}
+
+	// persist keys created before opening the key store
+	whisper.cryptoKeys.Range(func(id, key interface{}) bool {
+		if _, err := keyStore.readKey(id.(string)); err != nil {
+			err = keyStore.saveKey(id.(string), key)
+			if err != nil {
+				fmt.Println(err)
+			}
+		}
+		return true
+	})
+
+	whisper.keyStore = keyStore
+
+	return nil
+}
+
+// ListKeys returns all the keys in the key store and whether they are locked
+func (whisper *Whisper) ListKeys() ([]KeyInfo, error) {
+	if whisper.keyStore == nil {
+		return nil, fmt.Errorf("key store not open")
+	}
+
+	ids, err := whisper.keyStore.getKeyIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]KeyInfo, 0, len(ids))
+	for _, id := range ids {
+		encryptedKey, err := whisper.keyStore.readKey(id)
+		if err != nil {
+			continue
+		}
+		keys = append(keys, KeyInfo{ID: id, Symmetric: encryptedKey.Symmetric, Locked: !whisper.HasKey(id)})
+	}
+	return keys, nil
+}
+
+// LockKey removes the decrypted key from memory, the key stays in the key store
+func (whisper *Whisper) LockKey(id string) error {
+	if whisper.keyStore == nil {
+		return fmt.Errorf("key store not open")
+	}
+
+	if _, err := whisper.keyStore.readKey(id); err != nil {
+		return err
+	}
+
+	whisper.cryptoKeys.Delete(id)
+	return nil
+}
+
+// UnlockKey decrypts the key in the key store with the passphrase given and makes it available under its id
+func (whisper *Whisper) UnlockKey(id, passphrase string) error {
+	if whisper.keyStore == nil {
+		return fmt.Errorf("key store not open")
+	}
+
+	key, err := whisper.keyStore.loadKey(id, passphrase)
+	if err != nil {
+		return err
+	}
+
+	whisper.cryptoKeys.Store(id, key)
+	return nil
+}
@@ -0,0 +1,366 @@
+/* Contributors: Andrea Piccione */
+
+package whisper
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/dedis/protobuf"
+	"github.com/mikanikos/DSignal/gossiper"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MailServer archives envelopes on disk beyond their expiry and serves them to peers on request
+type MailServer struct {
+	archiveFolder string
+	// archived envelopes sent before this time ago are deleted
+	retention time.Duration
+	// bytes of the archived envelopes, the oldest ones are deleted above maxArchiveBytes
+	archiveSize int64
+	mutex       sync.RWMutex
+
+	// peer -> time of the last request served
+	lastRequests map[string]time.Time
+	requestMutex sync.Mutex
+}
+
+// pendingMailRequest sent to a mail server: its direct envelopes are accepted until the reply is complete, it's too big or it's late
+type pendingMailRequest struct {
+	deadline  time.Time
+	envelopes int
+	size      int
+}
+
+// MailRequest asks a mail server for the envelopes sent in a time range and matching a bloom filter
+type MailRequest struct {
+	Lower uint32
+	Upper uint32
+	Bloom []byte
+}
+
+// NewMailServer creates a mail server which archives envelopes in the folder given and keeps them for the retention period
+func NewMailServer(archiveFolder string, retention time.Duration) (*MailServer, error) {
+	if retention <= 0 {
+		return nil, fmt.Errorf("invalid retention period")
+	}
+	err := os.MkdirAll(archiveFolder, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(archiveFolder)
+	if err != nil {
+		return nil, err
+	}
+	archiveSize := int64(0)
+	for _, file := range files {
+		archiveSize += file.Size()
+	}
+
+	return &MailServer{archiveFolder: archiveFolder, retention: retention, archiveSize: archiveSize, lastRequests: make(map[string]time.Time)}, nil
+}
+
+// allowRequest checks that the peer didn't send another request recently
+func (mailServer *MailServer) allowRequest(peer string) bool {
+	mailServer.requestMutex.Lock()
+	defer mailServer.requestMutex.Unlock()
+
+	now := time.Now()
+	for p, requestTime := range mailServer.lastRequests {
+		if now.Sub(requestTime) >= mailRequestInterval {
+			delete(mailServer.lastRequests, p)
+		}
+	}
+
+	if _, loaded := mailServer.lastRequests[peer]; loaded {
+		return false
+	}
+	mailServer.lastRequests[peer] = now
+	return true
+}
+
+// removeOldEnvelopes deletes the archived envelopes sent before the retention period
+func (mailServer *MailServer) removeOldEnvelopes() {
+	mailServer.mutex.Lock()
+	defer mailServer.mutex.Unlock()
+
+	files, err := ioutil.ReadDir(mailServer.archiveFolder)
+	if err != nil {
+		return
+	}
+
+	oldest := time.Now().Add(-mailServer.retention).Unix()
+	for _, file := range files {
+		nameParts := strings.SplitN(file.Name(), "_", 2)
+		if len(nameParts) != 2 {
+			continue
+		}
+		sent, err := strconv.ParseUint(nameParts[0], 10, 32)
+		if err != nil || int64(sent) >= oldest {
+			continue
+		}
+		if os.Remove(filepath.Join(mailServer.archiveFolder, file.Name())) == nil {
+			mailServer.archiveSize -= file.Size()
+		}
+	}
+
+	mailServer.removeOldestEnvelopesUnsafe()
+}
+
+// removeOldestEnvelopesUnsafe deletes the oldest archived envelopes while the archive is above maxArchiveBytes, without locking.
+// It frees some more room so that the folder is not read for every new envelope
+func (mailServer *MailServer) removeOldestEnvelopesUnsafe() {
+	if mailServer.archiveSize <= maxArchiveBytes {
+		return
+	}
+
+	// file names start with the sent time, so they're listed oldest first
+	files, err := ioutil.ReadDir(mailServer.archiveFolder)
+	if err != nil {
+		return
+	}
+
+	for _, file := range files {
+		if mailServer.archiveSize <= maxArchiveBytes-maxArchiveBytes/10 {
+			break
+		}
+		if os.Remove(filepath.Join(mailServer.archiveFolder, file.Name())) == nil {
+			mailServer.archiveSize -= file.Size()
+		}
+	}
+}
+
+// archiveEnvelope stores the envelope on disk, the file name starts with the sent time to answer range requests
+func (mailServer *MailServer) archiveEnvelope(envelope *Envelope) error {
+	encoded, err := protobuf.Encode(envelope)
+	if err != nil {
+		return err
+	}
+
+	hash := envelope.GetHash()
+	fileName := fmt.Sprintf("%010d_%s", envelope.Expiry-envelope.TTL, hex.EncodeToString(hash[:]))
+
+	mailServer.mutex.Lock()
+	defer mailServer.mutex.Unlock()
+
+	// already archived
+	path := filepath.Join(mailServer.archiveFolder, fileName)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+
+	err = ioutil.WriteFile(path, encoded, 0644)
+	if err != nil {
+		return err
+	}
+	mailServer.archiveSize += int64(len(encoded))
+
+	mailServer.removeOldestEnvelopesUnsafe()
+	return nil
+}
+
+// getArchivedEnvelopes returns the archived envelopes sent in the request time range and matching its bloom filter, oldest first.
+// At most maxMailEnvelopes envelopes and maxMailBytes bytes are returned, the rest can be asked starting from the last envelope sent time
+func (mailServer *MailServer) getArchivedEnvelopes(request *MailRequest) ([]*Envelope, error) {
+	if request.Lower > request.Upper {
+		return nil, fmt.Errorf("invalid time range")
+	}
+	if request.Bloom != nil && len(request.Bloom) != BloomFilterSize {
+		return nil, fmt.Errorf("invalid bloom filter size")
+	}
+
+	mailServer.mutex.RLock()
+	defer mailServer.mutex.RUnlock()
+
+	files, err := ioutil.ReadDir(mailServer.archiveFolder)
+	if err != nil {
+		return nil, err
+	}
+
+	envelopes := make([]*Envelope, 0)
+	size := 0
+	for _, file := range files {
+		nameParts := strings.SplitN(file.Name(), "_", 2)
+		if len(nameParts) != 2 {
+			continue
+		}
+		sent, err := strconv.ParseUint(nameParts[0], 10, 32)
+		if err != nil || uint32(sent) < request.Lower || uint32(sent) > request.Upper {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(mailServer.archiveFolder, file.Name()))
+		if err != nil {
+			continue
+		}
+		envelope := &Envelope{}
+		if protobuf.Decode(data, envelope) != nil {
+			continue
+		}
+
+		if CheckFilterMatch(request.Bloom, envelope.GetBloom()) {
+			if len(envelopes) == maxMailEnvelopes || size+len(data) > maxMailBytes {
+				break
+			}
+			envelopes = append(envelopes, envelope)
+			size += len(data)
+		}
+	}
+
+	return envelopes, nil
+}
+
+// EnableMailServer turns on the mail server mode: all the envelopes are archived in the folder given for the retention period and served on request
+func (whisper *Whisper) EnableMailServer(archiveFolder string, retention time.Duration) error {
+	mailServer, err := NewMailServer(archiveFolder, retention)
+	if err != nil {
+		return err
+	}
+	mailServer.removeOldEnvelopes()
+	whisper.mailServer = mailServer
+
+	// a mail server is interested in every envelope
+	err = whisper.SetTopicInterest(nil)
+	if err != nil {
+		return err
+	}
+	return whisper.SetBloomFilter(GetFullBloomFilter())
+}
+
+// RequestHistoricMessages asks the mail server peer for the envelopes sent between lower and upper and matching the bloom filter (own bloom filter if nil)
+func (whisper *Whisper) RequestHistoricMessages(peer string, lower, upper uint32, bloom []byte) error {
+	address, err := net.ResolveUDPAddr("udp4", peer)
+	if err != nil {
+		return err
+	}
+
+	if bloom == nil {
+		bloom = whisper.GetBloomFilter()
+	}
+
+	request := &MailRequest{Lower: lower, Upper: upper, Bloom: bloom}
+	if request.Lower > request.Upper {
+		return fmt.Errorf("invalid time range")
+	}
+	if len(request.Bloom) != BloomFilterSize {
+		return fmt.Errorf("invalid bloom filter size")
+	}
+
+	payload, err := protobuf.Encode(request)
+	if err != nil {
+		return err
+	}
+
+	// direct envelopes are accepted only from mail servers that have been asked, until the reply is complete
+	whisper.mailRequestsMutex.Lock()
+	whisper.mailRequests[address.String()] = &pendingMailRequest{deadline: time.Now().Add(mailReplyTimeout)}
+	whisper.mailRequestsMutex.Unlock()
+
+	packet := &gossiper.GossipPacket{WhisperPacket: &gossiper.WhisperPacket{Code: p2pRequestCode, Payload: payload, Size: uint32(len(payload))}}
+	whisper.gossiper.ConnectionHandler.SendPacket(packet, address)
+
+	return nil
+}
+
+// handleMailRequest sends the archived envelopes matching the request directly to the peer.
+// Only peers of the gossiper are served, at most once every mailRequestInterval, so that the reply can't be used to flood other hosts
+func (whisper *Whisper) handleMailRequest(payload []byte, peer *net.UDPAddr) error {
+	if whisper.mailServer == nil {
+		return fmt.Errorf("mail server mode not enabled")
+	}
+	if whisper.gossiper.GetPeerFromString(peer.String()) == nil {
+		return fmt.Errorf("request from unknown peer")
+	}
+	if !whisper.mailServer.allowRequest(peer.String()) {
+		return fmt.Errorf("too many requests")
+	}
+
+	request := &MailRequest{}
+	err := protobuf.Decode(payload, request)
+	if err != nil {
+		return err
+	}
+
+	envelopes, err := whisper.mailServer.getArchivedEnvelopes(request)
+	if err != nil {
+		return err
+	}
+
+	for _, envelope := range envelopes {
+		packetToSend, err := protobuf.Encode(envelope)
+		if err != nil {
+			continue
+		}
+		packet := &gossiper.GossipPacket{WhisperPacket: &gossiper.WhisperPacket{Code: p2pMessageCode, Payload: packetToSend, Size: uint32(len(packetToSend))}}
+		whisper.gossiper.ConnectionHandler.SendPacket(packet, peer)
+	}
+
+	// an empty direct message tells the peer that the reply is complete
+	packet := &gossiper.GossipPacket{WhisperPacket: &gossiper.WhisperPacket{Code: p2pMessageCode}}
+	whisper.gossiper.ConnectionHandler.SendPacket(packet, peer)
+
+	fmt.Println("\nWhisper: sent " + fmt.Sprint(len(envelopes)) + " archived envelopes to peer " + peer.String())
+
+	return nil
+}
+
+// acceptMailEnvelope checks that the peer is a mail server with a pending request and that its reply is not too big yet.
+// An empty envelope completes the reply, the peer is not trusted anymore
+func (whisper *Whisper) acceptMailEnvelope(peer string, size int) bool {
+	whisper.mailRequestsMutex.Lock()
+	defer whisper.mailRequestsMutex.Unlock()
+
+	request, loaded := whisper.mailRequests[peer]
+	if !loaded {
+		return false
+	}
+
+	request.envelopes++
+	request.size += size
+	if size == 0 || time.Now().After(request.deadline) || request.envelopes > maxMailEnvelopes || request.size > maxMailBytes {
+		delete(whisper.mailRequests, peer)
+		return false
+	}
+	return true
+}
+
+// removeExpiredMailRequests forgets the mail servers that didn't complete their reply in time
+func (whisper *Whisper) removeExpiredMailRequests() {
+	whisper.mailRequestsMutex.Lock()
+	defer whisper.mailRequestsMutex.Unlock()
+
+	for peer, request := range whisper.mailRequests {
+		if time.Now().After(request.deadline) {
+			delete(whisper.mailRequests, peer)
+		}
+	}
+}
+
+// handleP2PEnvelope delivers an envelope received from a mail server to the filters, bypassing expiry and pow checks
+func (whisper *Whisper) handleP2PEnvelope(payload []byte, peer *net.UDPAddr) error {
+	if !whisper.acceptMailEnvelope(peer.String(), len(payload)) {
+		if len(payload) == 0 {
+			return nil
+		}
+		return fmt.Errorf("direct envelope from peer not asked")
+	}
+
+	envelope := &Envelope{}
+	err := protobuf.Decode(payload, envelope)
+	if err != nil {
+		return err
+	}
+
+	// pow is still needed by the filters
+	envelope.GetPow()
+	whisper.filters.NotifySubscribers(envelope)
+
+	return nil
+}
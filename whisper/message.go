@@ -3,28 +3,40 @@
 package whisper
 
 import (
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/ecdsa"
 	crand "crypto/rand"
 	"encoding/binary"
+	"fmt"
 	"github.com/dedis/protobuf"
 	ecies "github.com/ecies/go"
 	"golang.org/x/crypto/sha3"
 	"io"
+	gmath "math"
 	"math/big"
+	"runtime"
+	"sync"
 	"time"
 )
 
 // MessageParams specifies all the parameters needed to prepare an envelope
 type MessageParams struct {
-	Src     *ecies.PrivateKey
-	Dst     *ecies.PublicKey
-	KeySym  []byte
-	Topic   Topic
-	PowTime uint32
-	TTL     uint32
-	Payload []byte
-	Padding []byte
+	Src       *ecies.PrivateKey
+	Dst       *ecies.PublicKey
+	KeySym    []byte
+	Topic     Topic
+	PowTime   uint32
+	PowTarget float64
+	TTL       uint32
+	Payload   []byte
+	Padding   []byte
+
+	// set only if the payload is a part of a bigger one
+	partID    []byte
+	partIndex uint16
+	partCount uint16
 }
 
 //ReceivedMessage is a message received and decrypted
@@ -34,29 +46,40 @@ type ReceivedMessage struct {
 	Src     *ecies.PublicKey
 	Dst     *ecies.PublicKey
 	Payload []byte
+	Padding []byte
 	Topic   Topic
+	Pow     float64
 
 	SymKeyHash   [32]byte
 	EnvelopeHash [32]byte
+
+	// set only if the payload is a part of a bigger one
+	partID    []byte
+	partIndex uint16
+	partCount uint16
 }
 
-// appendPadding appends random padding to the message
-func (params *MessageParams) appendPadding() error {
-	bytes, err := protobuf.Encode(params)
-	if err != nil {
-		return err
+// appendPadding appends the padding given by the user, then random padding so that the final size (signature included) is a multiple of padSizeLimit
+func (params *MessageParams) appendPadding(raw []byte) ([]byte, error) {
+	// user padding first, the random one only rounds up to the bucket
+	raw = append(raw, params.Padding...)
+
+	rawSize := len(raw)
+	if params.Src != nil {
+		rawSize += publicKeyLength + signatureLength
 	}
-	rawSize := len(bytes)
 	odd := rawSize % padSizeLimit
+	if odd == 0 {
+		return raw, nil
+	}
 	paddingSize := padSizeLimit - odd
 
 	pad := make([]byte, paddingSize)
-	_, err = crand.Read(pad)
+	_, err := crand.Read(pad)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	params.Payload = pad
-	return nil
+	return append(raw, pad...), nil
 }
 
 // encryptWithPublicKey encrypts a message with a public key.
@@ -83,62 +106,268 @@ func encryptWithSymmetricKey(data []byte, key []byte) ([]byte, error) {
 	return encrypted, nil
 }
 
-// GetEnvelopeFromMessage encrypts the message and prepare the Envelope
+// convertToECDSA wraps the secp256k1 private key so that it can be used for ecdsa signatures
+func convertToECDSA(key *ecies.PrivateKey) *ecdsa.PrivateKey {
+	return &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{Curve: key.Curve, X: key.X, Y: key.Y},
+		D:         key.D,
+	}
+}
+
+// signWithPrivateKey signs the sha3 hash of the data and returns the signature as r || s
+func signWithPrivateKey(data []byte, key *ecies.PrivateKey) ([]byte, error) {
+	hash := sha3.Sum256(data)
+	r, s, err := ecdsa.Sign(crand.Reader, convertToECDSA(key), hash[:])
+	if err != nil {
+		return nil, err
+	}
+	signature := make([]byte, signatureLength)
+	r.FillBytes(signature[:signatureLength/2])
+	s.FillBytes(signature[signatureLength/2:])
+	return signature, nil
+}
+
+// verifySignature checks that the signature of the data was produced by the given public key
+func verifySignature(data, signature []byte, key *ecies.PublicKey) bool {
+	hash := sha3.Sum256(data)
+	r := new(big.Int).SetBytes(signature[:signatureLength/2])
+	s := new(big.Int).SetBytes(signature[signatureLength/2:])
+	return ecdsa.Verify(&ecdsa.PublicKey{Curve: key.Curve, X: key.X, Y: key.Y}, hash[:], r, s)
+}
+
+// buildRawPayload creates the message layout: flags | part id, index and count (optional) | payload size | payload | padding | public key and signature (optional)
+func (params *MessageParams) buildRawPayload() ([]byte, error) {
+	raw := make([]byte, flagsLength, flagsLength+partHeaderLength+payloadSizeLength+len(params.Payload)+padSizeLimit+publicKeyLength+signatureLength)
+
+	if params.partCount > 1 {
+		raw[0] |= partFlag
+		header := make([]byte, partHeaderLength)
+		copy(header, params.partID)
+		binary.BigEndian.PutUint16(header[partIDLength:], params.partIndex)
+		binary.BigEndian.PutUint16(header[partIDLength+2:], params.partCount)
+		raw = append(raw, header...)
+	}
+
+	size := make([]byte, payloadSizeLength)
+	binary.BigEndian.PutUint32(size, uint32(len(params.Payload)))
+	raw = append(raw, size...)
+	raw = append(raw, params.Payload...)
+
+	if params.Src != nil {
+		raw[0] |= signatureFlag
+	}
+
+	raw, err := params.appendPadding(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	if params.Src != nil {
+		signature, err := signWithPrivateKey(raw, params.Src)
+		if err != nil {
+			return nil, err
+		}
+		raw = append(raw, params.Src.PublicKey.Bytes(false)...)
+		raw = append(raw, signature...)
+	}
+
+	return raw, nil
+}
+
+// parseRawPayload extracts payload and padding from the decrypted data and, if the message is signed, verifies the signature and recovers the sender key
+func (msg *ReceivedMessage) parseRawPayload(raw []byte) error {
+	if len(raw) < flagsLength+payloadSizeLength {
+		return fmt.Errorf("message too short")
+	}
+
+	flags := raw[0]
+	end := len(raw)
+
+	if flags&signatureFlag != 0 {
+		if end < flagsLength+payloadSizeLength+publicKeyLength+signatureLength {
+			return fmt.Errorf("signed message too short")
+		}
+		signature := raw[end-signatureLength:]
+		key, err := ecies.NewPublicKeyFromBytes(raw[end-signatureLength-publicKeyLength : end-signatureLength])
+		if err != nil {
+			return fmt.Errorf("invalid sender public key")
+		}
+		end -= publicKeyLength + signatureLength
+		if !verifySignature(raw[:end], signature, key) {
+			return fmt.Errorf("invalid signature")
+		}
+		msg.Src = key
+	}
+
+	beg := flagsLength
+
+	if flags&partFlag != 0 {
+		if end < beg+partHeaderLength+payloadSizeLength {
+			return fmt.Errorf("message part too short")
+		}
+		msg.partID = raw[beg : beg+partIDLength]
+		msg.partIndex = binary.BigEndian.Uint16(raw[beg+partIDLength:])
+		msg.partCount = binary.BigEndian.Uint16(raw[beg+partIDLength+2:])
+		if msg.partCount == 0 || msg.partCount > maxMessageParts || msg.partIndex >= msg.partCount {
+			return fmt.Errorf("invalid message part")
+		}
+		beg += partHeaderLength
+	}
+
+	if end < beg+payloadSizeLength {
+		return fmt.Errorf("message too short")
+	}
+	size := binary.BigEndian.Uint32(raw[beg:])
+	beg += payloadSizeLength
+	if uint64(size) > uint64(end-beg) {
+		return fmt.Errorf("invalid payload size")
+	}
+
+	msg.Payload = raw[beg : beg+int(size)]
+	msg.Padding = raw[beg+int(size) : end]
+	return nil
+}
+
+// GetEnvelopeFromMessage signs and encrypts the message and prepare the Envelope
 func (params *MessageParams) GetEnvelopeFromMessage() (envelope *Envelope, err error) {
+	return params.GetEnvelopeFromMessageWithContext(context.Background())
+}
+
+// GetEnvelopeFromMessageWithContext prepares the Envelope, mining can be cancelled with the context
+func (params *MessageParams) GetEnvelopeFromMessageWithContext(ctx context.Context) (envelope *Envelope, err error) {
 	if params.TTL == 0 {
 		params.TTL = DefaultTTL
 	}
 
+	raw, err := params.buildRawPayload()
+	if err != nil {
+		return nil, err
+	}
+
 	var encrypted []byte
 
 	if params.Dst != nil {
-		encrypted, err = encryptWithPublicKey(params.Payload, params.Dst)
+		encrypted, err = encryptWithPublicKey(raw, params.Dst)
 		if err != nil {
 			return nil, err
 		}
 	} else if params.KeySym != nil {
-		encrypted, err = encryptWithSymmetricKey(params.Payload, params.KeySym)
+		encrypted, err = encryptWithSymmetricKey(raw, params.KeySym)
 		if err != nil {
 			return nil, err
 		}
 	} else {
-		encrypted = params.Payload
+		encrypted = raw
 	}
 
 	envelope = NewEnvelope(params.TTL, params.Topic, encrypted)
 
 	// add nonce for requiring enough pow
-	envelope.addNonceForPow(params)
+	_, err = envelope.mineNonce(ctx, params.PowTarget, params.PowTime)
+	if err != nil {
+		return nil, err
+	}
 
 	return envelope, nil
 }
 
-func (e *Envelope) addNonceForPow(options *MessageParams) {
+// mineNonce looks for the nonce with the highest pow using all the cores, each one on its own range of nonces.
+// It stops when the target is reached (if any), the pow time is over or the context is done, and returns the pow achieved.
+// An error is returned if the target is not reached in time
+func (e *Envelope) mineNonce(ctx context.Context, target float64, powTime uint32) (float64, error) {
+
+	// nothing to do
+	if target <= 0 && powTime == 0 {
+		e.computePow(0)
+		return e.pow, nil
+	}
 
-	e.Expiry += options.PowTime
+	// time budget, even with a target it can't go on forever
+	budget := time.Duration(powTime) * time.Second
+	if powTime == 0 {
+		budget = time.Duration(DefaultMaxPowTime) * time.Second
+	} else if target <= 0 {
+		// the whole budget is spent, don't let the envelope expire meanwhile
+		e.Expiry += powTime
+	}
 
-	bestLeadingZeros := 0
+	miningCtx, cancel := context.WithTimeout(ctx, budget)
+	defer cancel()
+
+	// leading zeros needed to reach the target, using the biggest size the envelope can have with any nonce
+	requiredZeros := 257
+	if target > 0 {
+		e.Nonce = gmath.MaxUint64
+		requiredZeros = int(gmath.Ceil(gmath.Log2(target * float64(e.GetSize()) * float64(e.TTL))))
+	}
 
 	encodedEnvWithoutNonce, _ := protobuf.Encode([]interface{}{e.Expiry, e.TTL, e.Topic, e.Data})
-	buf := make([]byte, len(encodedEnvWithoutNonce)+8)
-	copy(buf, encodedEnvWithoutNonce)
-
-	finish := time.Now().Add(time.Duration(options.PowTime) * time.Second).UnixNano()
-	for nonce := uint64(0); time.Now().UnixNano() < finish; {
-		for i := 0; i < 1024; i++ {
-			binary.BigEndian.PutUint64(buf[len(encodedEnvWithoutNonce):], nonce)
-			d := sha3.New256()
-			d.Write(buf)
-			powHash := new(big.Int).SetBytes(d.Sum(nil))
-			leadingZeros := 256 - powHash.BitLen()
-			if leadingZeros > bestLeadingZeros {
-				e.Nonce, bestLeadingZeros = nonce, leadingZeros
+
+	workers := runtime.NumCPU()
+	rangeSize := gmath.MaxUint64 / uint64(workers)
+
+	// each worker keeps its best nonce, they're merged at the end
+	bestNonces := make([]uint64, workers)
+	bestLeadingZeros := make([]int, workers)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int, first uint64) {
+			defer wg.Done()
+
+			buf := make([]byte, len(encodedEnvWithoutNonce)+8)
+			copy(buf, encodedEnvWithoutNonce)
+
+			bestNonce, best := first, -1
+			defer func() {
+				bestNonces[w], bestLeadingZeros[w] = bestNonce, best
+			}()
+
+			for nonce := first; miningCtx.Err() == nil && nonce-first < rangeSize; {
+				for i := 0; i < 1024; i++ {
+					binary.BigEndian.PutUint64(buf[len(encodedEnvWithoutNonce):], nonce)
+					d := sha3.New256()
+					d.Write(buf)
+					powHash := new(big.Int).SetBytes(d.Sum(nil))
+					leadingZeros := 256 - powHash.BitLen()
+
+					if leadingZeros > best {
+						bestNonce, best = nonce, leadingZeros
+
+						// target reached, stop everybody
+						if leadingZeros >= requiredZeros {
+							cancel()
+							return
+						}
+					}
+					nonce++
+				}
 			}
-			nonce++
+		}(w, uint64(w)*rangeSize)
+	}
+	wg.Wait()
+
+	best := 0
+	for w := range bestLeadingZeros {
+		if bestLeadingZeros[w] > bestLeadingZeros[best] {
+			best = w
 		}
 	}
 
+	e.Nonce = bestNonces[best]
 	e.computePow(0)
+
+	// cancelled by the caller, not by the pow time
+	if ctx.Err() != nil {
+		return e.pow, ctx.Err()
+	}
+
+	if target > 0 && e.pow < target {
+		return e.pow, fmt.Errorf("pow target %v not reached in time, best pow %v", target, e.pow)
+	}
+
+	return e.pow, nil
 }
 
 // decryptWithSymmetricKey decrypts a message with symmetric key
@@ -0,0 +1,197 @@
+/* Contributors: Andrea Piccione */
+
+package whisper
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"time"
+)
+
+// partialMessage collects the parts of a big message until all of them arrive
+type partialMessage struct {
+	parts    []*ReceivedMessage
+	received int
+	// bytes of the payloads received
+	size int
+	// the parts can be forgotten after this time
+	expiry uint32
+}
+
+// splitMessage splits the payload of the message in parts, each one carried by its own envelope.
+// Padding given by the user goes in the last part
+func (params *MessageParams) splitMessage() ([]*MessageParams, error) {
+	if len(params.Payload) <= maxPartSize {
+		return []*MessageParams{params}, nil
+	}
+
+	// the receivers don't reassemble bigger messages
+	count := (len(params.Payload) + maxPartSize - 1) / maxPartSize
+	if count > maxMessageParts || len(params.Payload) > int(MaxMessageSize) {
+		return nil, fmt.Errorf("message too big, at most %d bytes allowed", MaxMessageSize)
+	}
+
+	partID, err := generateRandomBytes(partIDLength)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := make([]*MessageParams, count)
+	for i := range parts {
+		end := (i + 1) * maxPartSize
+		if end > len(params.Payload) {
+			end = len(params.Payload)
+		}
+
+		part := *params
+		part.Payload = params.Payload[i*maxPartSize : end]
+		part.partID = partID
+		part.partIndex = uint16(i)
+		part.partCount = uint16(count)
+		if i != count-1 {
+			part.Padding = nil
+		}
+		parts[i] = &part
+	}
+
+	return parts, nil
+}
+
+// createEnvelopes signs, encrypts and mines the envelopes of all the parts of the message, checking their size
+func (whisper *Whisper) createEnvelopes(ctx context.Context, params *MessageParams) ([]*Envelope, error) {
+	parts, err := params.splitMessage()
+	if err != nil {
+		return nil, err
+	}
+
+	envelopes := make([]*Envelope, 0, len(parts))
+	for _, part := range parts {
+
+		// don't waste time on pow if the message can't be accepted anyway
+		if uint32(len(part.Payload)+len(part.Padding)) > whisper.GetMaxMessageSize() {
+			return nil, fmt.Errorf("message size exceeds the maximum allowed")
+		}
+
+		env, err := part.GetEnvelopeFromMessageWithContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		if uint32(env.GetSize()) > whisper.GetMaxMessageSize() {
+			return nil, fmt.Errorf("message size exceeds the maximum allowed")
+		}
+
+		envelopes = append(envelopes, env)
+	}
+
+	return envelopes, nil
+}
+
+// addPart stores the part of a message for the filter, it returns the whole message once all the parts arrived.
+// Each filter can have at most maxPendingMessages messages and maxPendingPartBytes bytes pending, each message at most MaxMessageSize bytes
+func (f *Filter) addPart(msg *ReceivedMessage) *ReceivedMessage {
+	f.Mutex.Lock()
+	defer f.Mutex.Unlock()
+
+	if f.parts == nil {
+		f.parts = make(map[string]*partialMessage)
+	}
+
+	id := hex.EncodeToString(msg.partID)
+	partial, loaded := f.parts[id]
+	if !loaded {
+		// too many messages being reassembled, drop it
+		if len(f.parts) >= maxPendingMessages {
+			return nil
+		}
+		partial = &partialMessage{parts: make([]*ReceivedMessage, msg.partCount)}
+		f.parts[id] = partial
+	}
+
+	// drop parts not consistent with the ones already received
+	if int(msg.partCount) != len(partial.parts) || partial.parts[msg.partIndex] != nil {
+		return nil
+	}
+
+	// message too big or no room for the part, the whole message is dropped
+	if partial.size+len(msg.Payload) > int(MaxMessageSize) || f.partsSize+len(msg.Payload) > maxPendingPartBytes {
+		f.removePartial(id)
+		return nil
+	}
+
+	partial.parts[msg.partIndex] = msg
+	partial.received++
+	partial.size += len(msg.Payload)
+	f.partsSize += len(msg.Payload)
+	if expiry := msg.Sent + msg.TTL; expiry > partial.expiry {
+		partial.expiry = expiry
+	}
+
+	if partial.received < len(partial.parts) {
+		return nil
+	}
+
+	f.removePartial(id)
+	return reassembleParts(partial.parts)
+}
+
+// removePartial message of the filter, freeing its bytes
+func (f *Filter) removePartial(id string) {
+	if partial, loaded := f.parts[id]; loaded {
+		f.partsSize -= partial.size
+		delete(f.parts, id)
+	}
+}
+
+// reassembleParts builds the whole message from its parts, they must all come from the same sender
+func reassembleParts(parts []*ReceivedMessage) *ReceivedMessage {
+	first := parts[0]
+
+	msg := &ReceivedMessage{
+		Sent:         first.Sent,
+		TTL:          first.TTL,
+		Src:          first.Src,
+		Dst:          first.Dst,
+		Padding:      parts[len(parts)-1].Padding,
+		Topic:        first.Topic,
+		Pow:          math.Inf(1),
+		SymKeyHash:   first.SymKeyHash,
+		EnvelopeHash: first.EnvelopeHash,
+	}
+
+	size := 0
+	for _, part := range parts {
+		size += len(part.Payload)
+	}
+	msg.Payload = make([]byte, 0, size)
+
+	for _, part := range parts {
+		if (part.Src == nil) != (first.Src == nil) || (part.Src != nil && !bytes.Equal(part.Src.Bytes(false), first.Src.Bytes(false))) {
+			return nil
+		}
+		msg.Payload = append(msg.Payload, part.Payload...)
+		msg.Pow = math.Min(msg.Pow, part.Pow)
+	}
+
+	return msg
+}
+
+// removeExpiredParts drops the incomplete messages whose parts are expired
+func (fs *FilterStorage) removeExpiredParts() {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+
+	now := uint32(time.Now().Unix())
+	for _, sub := range fs.subscribers {
+		sub.Mutex.Lock()
+		for id, partial := range sub.parts {
+			if partial.expiry < now {
+				sub.removePartial(id)
+			}
+		}
+		sub.Mutex.Unlock()
+	}
+}
@@ -0,0 +1,203 @@
+/* Contributors: Andrea Piccione */
+
+package whisper
+
+import (
+	"fmt"
+	"github.com/dedis/protobuf"
+	"github.com/mikanikos/DSignal/gossiper"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// RateLimits for incoming whisper packets, per second, 0 means no limit
+type RateLimits struct {
+	PeerEnvelopes   float64
+	PeerBytes       float64
+	IPEnvelopes     float64
+	IPBytes         float64
+	GlobalEnvelopes float64
+	GlobalBytes     float64
+}
+
+// tokenBucket allows a rate of tokens per second, with a burst of one second
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateBuckets for both packets and bytes of a scope (peer, ip or global)
+type rateBuckets struct {
+	envelopes tokenBucket
+	bytes     tokenBucket
+}
+
+// RateLimiter checks incoming packets against the token buckets of their peer, their ip and the global ones
+type RateLimiter struct {
+	limits RateLimits
+	peers  map[string]*rateBuckets
+	ips    map[string]*rateBuckets
+	global *rateBuckets
+	mutex  sync.Mutex
+}
+
+// NewRateLimiter create new rate limiter with default limits
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{
+		limits: RateLimits{
+			PeerEnvelopes:   DefaultPeerEnvelopesRate,
+			PeerBytes:       DefaultPeerBytesRate,
+			IPEnvelopes:     DefaultIPEnvelopesRate,
+			IPBytes:         DefaultIPBytesRate,
+			GlobalEnvelopes: DefaultGlobalEnvelopesRate,
+			GlobalBytes:     DefaultGlobalBytesRate,
+		},
+		peers:  make(map[string]*rateBuckets),
+		ips:    make(map[string]*rateBuckets),
+		global: newRateBuckets(time.Now()),
+	}
+}
+
+// create full buckets
+func newRateBuckets(now time.Time) *rateBuckets {
+	return &rateBuckets{
+		envelopes: tokenBucket{tokens: math.Inf(1), last: now},
+		bytes:     tokenBucket{tokens: math.Inf(1), last: now},
+	}
+}
+
+// refill the bucket according to the time elapsed, up to a burst of one second
+func (bucket *tokenBucket) refill(rate float64, now time.Time) {
+	if rate <= 0 {
+		// no limit, keep it full in case a limit is set later
+		bucket.tokens = math.Inf(1)
+	} else {
+		bucket.tokens = math.Min(rate, bucket.tokens+now.Sub(bucket.last).Seconds()*rate)
+	}
+	bucket.last = now
+}
+
+// check if the bucket has enough tokens, a request bigger than the burst only needs a full bucket
+func (bucket *tokenBucket) check(rate, amount float64) bool {
+	return rate <= 0 || bucket.tokens >= math.Min(amount, rate)
+}
+
+// take tokens from the bucket
+func (bucket *tokenBucket) take(rate, amount float64) {
+	if rate > 0 {
+		bucket.tokens -= amount
+	}
+}
+
+// get the buckets for the key, creating them if needed
+func getRateBuckets(bucketsMap map[string]*rateBuckets, key string, now time.Time) *rateBuckets {
+	buckets, loaded := bucketsMap[key]
+	if !loaded {
+		buckets = newRateBuckets(now)
+		bucketsMap[key] = buckets
+	}
+	return buckets
+}
+
+// allow checks if a packet of the given size from the peer is within the limits, consuming tokens only if it is.
+// If not, it also tells if the peer itself (or its ip) exceeded its limits rather than the whole node
+func (rateLimiter *RateLimiter) allow(address *net.UDPAddr, size int) (bool, bool) {
+	rateLimiter.mutex.Lock()
+	defer rateLimiter.mutex.Unlock()
+
+	now := time.Now()
+	limits := rateLimiter.limits
+
+	peer := getRateBuckets(rateLimiter.peers, address.String(), now)
+	ip := getRateBuckets(rateLimiter.ips, address.IP.String(), now)
+
+	peer.envelopes.refill(limits.PeerEnvelopes, now)
+	peer.bytes.refill(limits.PeerBytes, now)
+	ip.envelopes.refill(limits.IPEnvelopes, now)
+	ip.bytes.refill(limits.IPBytes, now)
+	rateLimiter.global.envelopes.refill(limits.GlobalEnvelopes, now)
+	rateLimiter.global.bytes.refill(limits.GlobalBytes, now)
+
+	bytes := float64(size)
+
+	peerAllowed := peer.envelopes.check(limits.PeerEnvelopes, 1) && peer.bytes.check(limits.PeerBytes, bytes) &&
+		ip.envelopes.check(limits.IPEnvelopes, 1) && ip.bytes.check(limits.IPBytes, bytes)
+	if !peerAllowed {
+		return false, true
+	}
+
+	globalAllowed := rateLimiter.global.envelopes.check(limits.GlobalEnvelopes, 1) && rateLimiter.global.bytes.check(limits.GlobalBytes, bytes)
+	if !globalAllowed {
+		return false, false
+	}
+
+	peer.envelopes.take(limits.PeerEnvelopes, 1)
+	peer.bytes.take(limits.PeerBytes, bytes)
+	ip.envelopes.take(limits.IPEnvelopes, 1)
+	ip.bytes.take(limits.IPBytes, bytes)
+	rateLimiter.global.envelopes.take(limits.GlobalEnvelopes, 1)
+	rateLimiter.global.bytes.take(limits.GlobalBytes, bytes)
+
+	return true, false
+}
+
+// removeIdleBuckets removes buckets of peers not seen for a while, they would be full anyway
+func (rateLimiter *RateLimiter) removeIdleBuckets() {
+	rateLimiter.mutex.Lock()
+	defer rateLimiter.mutex.Unlock()
+
+	for _, bucketsMap := range []map[string]*rateBuckets{rateLimiter.peers, rateLimiter.ips} {
+		for key, buckets := range bucketsMap {
+			if time.Since(buckets.envelopes.last) > expirationTimer {
+				delete(bucketsMap, key)
+			}
+		}
+	}
+}
+
+// getStatusSize returns the encoded size of the status, topics and signature included, the biggest size allowed if it can't be encoded
+func getStatusSize(status *gossiper.WhisperStatus) int {
+	encoded, err := protobuf.Encode(status)
+	if err != nil {
+		return int(MaxMessageSize)
+	}
+	return len(encoded)
+}
+
+// allowPacket checks the rate limits for the packet, penalizing the peer if it exceeded them
+func (whisper *Whisper) allowPacket(address *net.UDPAddr, size int) bool {
+	allowed, peerExceeded := whisper.rateLimiter.allow(address, size)
+	if peerExceeded {
+		whisper.penalizePeer(address.String(), rateLimitViolation)
+	}
+	return allowed
+}
+
+// GetRateLimits returns the current rate limits
+func (whisper *Whisper) GetRateLimits() RateLimits {
+	whisper.rateLimiter.mutex.Lock()
+	defer whisper.rateLimiter.mutex.Unlock()
+	return whisper.rateLimiter.limits
+}
+
+// SetRateLimits sets new rate limits, they apply immediately
+func (whisper *Whisper) SetRateLimits(limits RateLimits) error {
+	return whisper.rateLimiter.setLimits(limits)
+}
+
+// setLimits sets new limits for the rate limiter, they apply immediately
+func (rateLimiter *RateLimiter) setLimits(limits RateLimits) error {
+	values := []float64{limits.PeerEnvelopes, limits.PeerBytes, limits.IPEnvelopes, limits.IPBytes, limits.GlobalEnvelopes, limits.GlobalBytes}
+	for _, value := range values {
+		if value < 0 || math.IsNaN(value) || math.IsInf(value, 0) {
+			return fmt.Errorf("invalid rate limit")
+		}
+	}
+
+	rateLimiter.mutex.Lock()
+	defer rateLimiter.mutex.Unlock()
+	rateLimiter.limits = limits
+	return nil
+}
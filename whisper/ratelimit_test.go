@@ -0,0 +1,88 @@
+package whisper
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// check the packet against the limits with the expected result
+func checkPacket(t *testing.T, rateLimiter *RateLimiter, address string, size int, expectedAllowed, expectedPeerExceeded bool) {
+	udpAddress, err := net.ResolveUDPAddr("udp4", address)
+	if err != nil {
+		t.Fatalf("failed when resolving address: %s", err)
+	}
+
+	allowed, peerExceeded := rateLimiter.allow(udpAddress, size)
+	if allowed != expectedAllowed || peerExceeded != expectedPeerExceeded {
+		t.Fatalf("failed when checking packet of %d bytes from %s: got allowed %v and peer exceeded %v, expected %v and %v", size, address, allowed, peerExceeded, expectedAllowed, expectedPeerExceeded)
+	}
+}
+
+// create rate limiter with the given limits
+func newTestRateLimiter(t *testing.T, limits RateLimits) *RateLimiter {
+	rateLimiter := NewRateLimiter()
+	err := rateLimiter.setLimits(limits)
+	if err != nil {
+		t.Fatalf("failed when setting limits: %s", err)
+	}
+	return rateLimiter
+}
+
+func TestRateLimitBuckets(t *testing.T) {
+
+	// no limits, everything is allowed
+	rateLimiter := newTestRateLimiter(t, RateLimits{})
+	checkPacket(t, rateLimiter, "10.0.0.1:1", 1000000, true, false)
+	checkPacket(t, rateLimiter, "10.0.0.1:1", 1000000, true, false)
+
+	// envelopes of a peer, other peers are not affected
+	rateLimiter = newTestRateLimiter(t, RateLimits{PeerEnvelopes: 2})
+	checkPacket(t, rateLimiter, "10.0.0.1:1", 1, true, false)
+	checkPacket(t, rateLimiter, "10.0.0.1:1", 1, true, false)
+	checkPacket(t, rateLimiter, "10.0.0.1:1", 1, false, true)
+	checkPacket(t, rateLimiter, "10.0.0.1:2", 1, true, false)
+
+	// envelopes of an ip, shared by all its ports
+	rateLimiter = newTestRateLimiter(t, RateLimits{IPEnvelopes: 2})
+	checkPacket(t, rateLimiter, "10.0.0.1:1", 1, true, false)
+	checkPacket(t, rateLimiter, "10.0.0.1:2", 1, true, false)
+	checkPacket(t, rateLimiter, "10.0.0.1:3", 1, false, true)
+	checkPacket(t, rateLimiter, "10.0.0.2:1", 1, true, false)
+
+	// bytes of a peer, tokens are consumed only by allowed packets
+	rateLimiter = newTestRateLimiter(t, RateLimits{PeerBytes: 100})
+	checkPacket(t, rateLimiter, "10.0.0.1:1", 60, true, false)
+	checkPacket(t, rateLimiter, "10.0.0.1:1", 60, false, true)
+	checkPacket(t, rateLimiter, "10.0.0.1:1", 40, true, false)
+
+	// a packet bigger than the burst is allowed with a full bucket
+	rateLimiter = newTestRateLimiter(t, RateLimits{PeerBytes: 100})
+	checkPacket(t, rateLimiter, "10.0.0.1:1", 500, true, false)
+	checkPacket(t, rateLimiter, "10.0.0.1:1", 1, false, true)
+
+	// the global limit is not the fault of the peer
+	rateLimiter = newTestRateLimiter(t, RateLimits{GlobalEnvelopes: 1})
+	checkPacket(t, rateLimiter, "10.0.0.1:1", 1, true, false)
+	checkPacket(t, rateLimiter, "10.0.0.2:1", 1, false, false)
+
+	// buckets refill over time
+	rateLimiter = newTestRateLimiter(t, RateLimits{PeerEnvelopes: 10})
+	for i := 0; i < 10; i++ {
+		checkPacket(t, rateLimiter, "10.0.0.1:1", 1, true, false)
+	}
+	checkPacket(t, rateLimiter, "10.0.0.1:1", 1, false, true)
+	time.Sleep(300 * time.Millisecond)
+	checkPacket(t, rateLimiter, "10.0.0.1:1", 1, true, false)
+}
+
+func TestInvalidRateLimits(t *testing.T) {
+
+	// negative limits are rejected
+	if NewRateLimiter().setLimits(RateLimits{PeerEnvelopes: -1}) == nil {
+		t.Fatalf("failed when setting negative envelopes limit: accepted")
+	}
+	if NewRateLimiter().setLimits(RateLimits{GlobalBytes: -0.5}) == nil {
+		t.Fatalf("failed when setting negative bytes limit: accepted")
+	}
+}
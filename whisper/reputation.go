@@ -0,0 +1,217 @@
+/* Contributors: Andrea Piccione */
+
+package whisper
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Violation is a kind of misbehaviour of a peer
+type Violation int
+
+// violations that are penalized, each one with its own penalty
+const (
+	lowPowViolation Violation = iota
+	timestampViolation
+	oversizeViolation
+	undecodableViolation
+	rateLimitViolation
+)
+
+// penalty added to the score of the peer for each violation
+var violationPenalties = map[Violation]float64{
+	lowPowViolation:      20,
+	timestampViolation:   10,
+	oversizeViolation:    50,
+	undecodableViolation: 50,
+	rateLimitViolation:   5,
+}
+
+// String representation of the violation
+func (violation Violation) String() string {
+	switch violation {
+	case lowPowViolation:
+		return "low pow"
+	case timestampViolation:
+		return "invalid timestamp"
+	case oversizeViolation:
+		return "oversize"
+	case undecodableViolation:
+		return "undecodable"
+	case rateLimitViolation:
+		return "rate limit exceeded"
+	}
+	return "unknown"
+}
+
+// envelopeError is returned when an envelope breaks the protocol, with the violation committed by the sender
+type envelopeError struct {
+	violation Violation
+	message   string
+}
+
+func (err *envelopeError) Error() string {
+	return err.message
+}
+
+// PeerScore tracks the misbehaviour of a peer
+type PeerScore struct {
+	// current penalty score, decays over time
+	Score float64
+	// last time the score was updated
+	LastUpdate time.Time
+	// number of bans received, used for the backoff
+	Bans uint
+	// peer is banned until this time
+	BannedUntil time.Time
+}
+
+// BannedPeer is a peer currently banned
+type BannedPeer struct {
+	Address     string
+	BannedUntil time.Time
+}
+
+// ReputationHandler keeps the score of the peers and bans them temporarily when it gets too high
+type ReputationHandler struct {
+	peers map[string]*PeerScore
+	mutex sync.RWMutex
+}
+
+// NewReputationHandler create new reputation handler
+func NewReputationHandler() *ReputationHandler {
+	return &ReputationHandler{
+		peers: make(map[string]*PeerScore),
+	}
+}
+
+// decay the score of the peer according to the time elapsed since last update
+func (peerScore *PeerScore) decay(now time.Time) {
+	elapsed := now.Sub(peerScore.LastUpdate)
+	peerScore.Score = peerScore.Score * math.Pow(0.5, elapsed.Seconds()/scoreHalfLife.Seconds())
+	peerScore.LastUpdate = now
+
+	// forget previous bans after good behaviour for long enough
+	if peerScore.Bans > 0 && peerScore.Score < 1 && now.Sub(peerScore.BannedUntil) > banMemory {
+		peerScore.Bans = 0
+	}
+}
+
+// penalize the peer for the violation, it returns true if the peer has been banned
+func (reputationHandler *ReputationHandler) penalize(peer string, violation Violation) bool {
+	reputationHandler.mutex.Lock()
+	defer reputationHandler.mutex.Unlock()
+
+	now := time.Now()
+
+	peerScore, loaded := reputationHandler.peers[peer]
+	if !loaded {
+		peerScore = &PeerScore{LastUpdate: now}
+		reputationHandler.peers[peer] = peerScore
+	}
+
+	peerScore.decay(now)
+	peerScore.Score += violationPenalties[violation]
+
+	if peerScore.Score < banThreshold {
+		return false
+	}
+
+	// ban time doubles at each ban, up to the limit
+	banTime := time.Duration(float64(banDuration) * math.Pow(2, float64(peerScore.Bans)))
+	if banTime > maxBanDuration {
+		banTime = maxBanDuration
+	}
+
+	peerScore.BannedUntil = now.Add(banTime)
+	peerScore.Bans++
+	peerScore.Score = 0
+
+	return true
+}
+
+// getScore gives the reputation of the peer to the gossiper: minus the current penalty, minus the threshold if banned
+func (reputationHandler *ReputationHandler) getScore(peer string) float64 {
+	reputationHandler.mutex.RLock()
+	defer reputationHandler.mutex.RUnlock()
+
+	peerScore, loaded := reputationHandler.peers[peer]
+	if !loaded {
+		return 0
+	}
+
+	now := time.Now()
+	if now.Before(peerScore.BannedUntil) {
+		return -banThreshold
+	}
+
+	// decay without updating, it's only a read
+	elapsed := now.Sub(peerScore.LastUpdate)
+	return -peerScore.Score * math.Pow(0.5, elapsed.Seconds()/scoreHalfLife.Seconds())
+}
+
+// isBanned checks if peer is currently banned
+func (reputationHandler *ReputationHandler) isBanned(peer string) bool {
+	reputationHandler.mutex.RLock()
+	defer reputationHandler.mutex.RUnlock()
+
+	peerScore, loaded := reputationHandler.peers[peer]
+	return loaded && time.Now().Before(peerScore.BannedUntil)
+}
+
+// removeForgottenPeers removes peers whose score has decayed and that are not banned anymore
+func (reputationHandler *ReputationHandler) removeForgottenPeers() {
+	reputationHandler.mutex.Lock()
+	defer reputationHandler.mutex.Unlock()
+
+	now := time.Now()
+	for peer, peerScore := range reputationHandler.peers {
+		peerScore.decay(now)
+		if peerScore.Score < 1 && peerScore.Bans == 0 && now.After(peerScore.BannedUntil) {
+			delete(reputationHandler.peers, peer)
+		}
+	}
+}
+
+// GetBannedPeers returns the peers currently banned, sorted by address
+func (whisper *Whisper) GetBannedPeers() []*BannedPeer {
+	whisper.reputationHandler.mutex.RLock()
+	defer whisper.reputationHandler.mutex.RUnlock()
+
+	now := time.Now()
+	bannedPeers := make([]*BannedPeer, 0)
+	for peer, peerScore := range whisper.reputationHandler.peers {
+		if now.Before(peerScore.BannedUntil) {
+			bannedPeers = append(bannedPeers, &BannedPeer{Address: peer, BannedUntil: peerScore.BannedUntil})
+		}
+	}
+
+	sort.Slice(bannedPeers, func(i, j int) bool {
+		return bannedPeers[i].Address < bannedPeers[j].Address
+	})
+
+	return bannedPeers
+}
+
+// UnbanPeer lifts the ban of the peer and resets its score
+func (whisper *Whisper) UnbanPeer(peer string) error {
+	whisper.reputationHandler.mutex.Lock()
+	defer whisper.reputationHandler.mutex.Unlock()
+
+	peerScore, loaded := whisper.reputationHandler.peers[peer]
+	if !loaded || !time.Now().Before(peerScore.BannedUntil) {
+		return fmt.Errorf("peer is not banned")
+	}
+
+	delete(whisper.reputationHandler.peers, peer)
+	return nil
+}
+
+// IsPeerBanned checks if the peer is currently banned
+func (whisper *Whisper) IsPeerBanned(peer string) bool {
+	return whisper.reputationHandler.isBanned(peer)
+}
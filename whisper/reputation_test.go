@@ -0,0 +1,56 @@
+package whisper
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestReputationDecay(t *testing.T) {
+
+	now := time.Now()
+
+	// no time elapsed, same score
+	peerScore := &PeerScore{Score: 100, LastUpdate: now}
+	peerScore.decay(now)
+	if peerScore.Score != 100 {
+		t.Fatalf("failed when decaying without time elapsed: got score %v", peerScore.Score)
+	}
+
+	// the score halves at each half life
+	peerScore = &PeerScore{Score: 100, LastUpdate: now.Add(-scoreHalfLife)}
+	peerScore.decay(now)
+	if math.Abs(peerScore.Score-50) > 1e-9 {
+		t.Fatalf("failed when decaying for one half life: got score %v", peerScore.Score)
+	}
+	if !peerScore.LastUpdate.Equal(now) {
+		t.Fatalf("failed when decaying: last update not changed")
+	}
+
+	peerScore = &PeerScore{Score: 100, LastUpdate: now.Add(-2 * scoreHalfLife)}
+	peerScore.decay(now)
+	if math.Abs(peerScore.Score-25) > 1e-9 {
+		t.Fatalf("failed when decaying for two half lives: got score %v", peerScore.Score)
+	}
+
+	// bans are kept while the score is still high
+	peerScore = &PeerScore{Score: 100, LastUpdate: now.Add(-scoreHalfLife), Bans: 2, BannedUntil: now.Add(-2 * banMemory)}
+	peerScore.decay(now)
+	if peerScore.Bans != 2 {
+		t.Fatalf("failed when keeping bans with high score: got %d bans", peerScore.Bans)
+	}
+
+	// bans are kept after a recent ban
+	peerScore = &PeerScore{Score: 0.5, LastUpdate: now, Bans: 2, BannedUntil: now.Add(-time.Hour)}
+	peerScore.decay(now)
+	if peerScore.Bans != 2 {
+		t.Fatalf("failed when keeping bans after recent ban: got %d bans", peerScore.Bans)
+	}
+
+	// bans are forgotten after good behaviour for long enough
+	peerScore = &PeerScore{Score: 0.5, LastUpdate: now, Bans: 2, BannedUntil: now.Add(-2 * banMemory)}
+	peerScore.decay(now)
+	if peerScore.Bans != 0 {
+		t.Fatalf("failed when forgetting bans after good behaviour: got %d bans", peerScore.Bans)
+	}
+}
@@ -4,10 +4,10 @@ package whisper
 
 import (
 	//"fmt"
-	"github.com/dedis/protobuf"
 	"github.com/mikanikos/DSignal/gossiper"
 	"math"
 	"net"
+	"sort"
 	"sync"
 	"time"
 )
@@ -16,11 +16,36 @@ import (
 type Status struct {
 	Pow   float64
 	Bloom []byte
+	// 0 means no limit known
+	MaxMsgSize uint32
+	// exact topics of interest, nil if only the bloom filter is known
+	Topics map[Topic]struct{}
+}
+
+// OriginStatus is the last status announced by an origin, with the peer it came from
+type OriginStatus struct {
+	Status
+	Address  string
+	LastSeen time.Time
+}
+
+// PeerStatus is the aggregated status of the origins reachable through a peer, nil bloom means interest in everything
+type PeerStatus struct {
+	Address    string
+	Bloom      []byte
+	Pow        float64
+	MaxMsgSize uint32
+	// number of origins reachable through the peer
+	Origins int
+	// time of the last status relayed by the peer
+	LastStatus time.Time
 }
 
 // RoutingHandler struct
 type RoutingHandler struct {
-	// peer -> aggregated bloom from that peer
+	// origin -> last status from that origin
+	originStatus map[string]*OriginStatus
+	// peer -> aggregated status of the origins reachable through that peer
 	peerStatus map[string]*Status
 	// track current last id to use the last updated information from peers
 	originLastID *gossiper.VectorClock
@@ -30,12 +55,13 @@ type RoutingHandler struct {
 // NewRoutingHandler create new routing handler
 func NewRoutingHandler() *RoutingHandler {
 	return &RoutingHandler{
-		peerStatus: make(map[string]*Status),
+		originStatus: make(map[string]*OriginStatus),
+		peerStatus:   make(map[string]*Status),
 		originLastID: &gossiper.VectorClock{Entries: make(map[string]uint32)},
 	}
 }
 
-// updateRoutingTable according to status messages
+// updateRoutingTable according to status messages, the new status replaces the previous one of the origin
 func (routingHandler *RoutingHandler) updateRoutingTable(whisperStatus *gossiper.WhisperStatus, address *net.UDPAddr) {
 
 	routingHandler.mutex.Lock()
@@ -44,37 +70,208 @@ func (routingHandler *RoutingHandler) updateRoutingTable(whisperStatus *gossiper
 	// if new packet with higher id, updateEnvelopes table
 	if routingHandler.updateLastOriginID(whisperStatus.Origin, whisperStatus.ID) {
 
-		status, loaded := routingHandler.peerStatus[address.String()]
+		status, loaded := routingHandler.originStatus[whisperStatus.Origin]
 		if !loaded {
-			routingHandler.peerStatus[address.String()] = &Status{}
-			status, _ = routingHandler.peerStatus[address.String()]
+			status = &OriginStatus{}
+			routingHandler.originStatus[whisperStatus.Origin] = status
 		}
 
+		// any status is a sign of life, the origin is reachable through the last peer that relayed it
+		status.Address = address.String()
+		status.LastSeen = time.Now()
+
 		if whisperStatus.Code == bloomFilterExCode || whisperStatus.Code == statusCode {
 			if whisperStatus.Bloom != nil && len(whisperStatus.Bloom) == BloomFilterSize {
-				if loaded {
-					status.Bloom = AggregateBloom(whisperStatus.Bloom, status.Bloom)
-				} else {
-					status.Bloom = whisperStatus.Bloom
-				}
+				status.Bloom = whisperStatus.Bloom
 				//fmt.Println("\nWhisper: routing table updated for BloomFilter, peer entry " + address.String())
 			}
 		}
 
 		if whisperStatus.Code == powRequirementCode || whisperStatus.Code == statusCode {
 			if !(math.IsInf(whisperStatus.Pow, 0) || math.IsNaN(whisperStatus.Pow) || whisperStatus.Pow < 0.0) {
-				if loaded {
-					status.Pow = math.Min(status.Pow, whisperStatus.Pow)
-				} else {
-					status.Pow = whisperStatus.Pow
-				}
+				status.Pow = whisperStatus.Pow
 				//fmt.Println("\nWhisper: routing table updated for PoW, peer entry " + address.String())
 			}
 		}
+
+		if whisperStatus.Code == topicInterestCode || whisperStatus.Code == statusCode {
+			status.Topics = nil
+			if whisperStatus.TopicInterest && len(whisperStatus.Topics) <= maxTopicInterest {
+				status.Topics = make(map[Topic]struct{})
+				for _, topic := range whisperStatus.Topics {
+					if len(topic) == TopicLength {
+						status.Topics[ConvertBytesToTopic(topic)] = struct{}{}
+					}
+				}
+			}
+		}
+
+		if whisperStatus.Code == maxMsgSizeCode || whisperStatus.Code == statusCode {
+			if whisperStatus.MaxMsgSize > 0 {
+				status.MaxMsgSize = whisperStatus.MaxMsgSize
+			}
+		}
+
+		routingHandler.updatePeerStatus()
 		//fmt.Println("\nWhisper: routing table updated, peer entry " + address.String())
 	}
 }
 
+// removeExpiredStatus removes origins that didn't send any status for too long
+func (routingHandler *RoutingHandler) removeExpiredStatus() {
+	routingHandler.mutex.Lock()
+	defer routingHandler.mutex.Unlock()
+
+	expired := false
+	for origin, status := range routingHandler.originStatus {
+		if time.Since(status.LastSeen) > statusExpiration {
+			delete(routingHandler.originStatus, origin)
+			expired = true
+		}
+	}
+
+	if expired {
+		routingHandler.updatePeerStatus()
+	}
+}
+
+// removePeer forgets the statuses of the origins reached through the peer
+func (routingHandler *RoutingHandler) removePeer(peer string) {
+	routingHandler.mutex.Lock()
+	defer routingHandler.mutex.Unlock()
+
+	for origin, status := range routingHandler.originStatus {
+		if status.Address == peer {
+			delete(routingHandler.originStatus, origin)
+		}
+	}
+	routingHandler.updatePeerStatus()
+}
+
+// updatePeerStatus aggregates the status of the origins for each peer: union of the blooms and topics, lowest pow and lowest max size
+func (routingHandler *RoutingHandler) updatePeerStatus() {
+	peerStatus := make(map[string]*Status)
+
+	for _, status := range routingHandler.originStatus {
+		aggregate, loaded := peerStatus[status.Address]
+		if !loaded {
+			peerStatus[status.Address] = &Status{Pow: status.Pow, Bloom: status.Bloom, MaxMsgSize: status.MaxMsgSize, Topics: copyTopics(status.Topics)}
+			continue
+		}
+
+		// exact topics only if all the origins advertised them
+		if aggregate.Topics == nil || status.Topics == nil {
+			aggregate.Topics = nil
+		} else {
+			for topic := range status.Topics {
+				aggregate.Topics[topic] = struct{}{}
+			}
+		}
+
+		aggregate.Pow = math.Min(aggregate.Pow, status.Pow)
+
+		// the peer would not relay envelopes bigger than the smallest limit
+		if aggregate.MaxMsgSize == 0 || (status.MaxMsgSize > 0 && status.MaxMsgSize < aggregate.MaxMsgSize) {
+			aggregate.MaxMsgSize = status.MaxMsgSize
+		}
+
+		// missing bloom means interest in everything
+		if aggregate.Bloom == nil || status.Bloom == nil {
+			aggregate.Bloom = nil
+		} else {
+			aggregate.Bloom = AggregateBloom(aggregate.Bloom, status.Bloom)
+		}
+	}
+
+	routingHandler.peerStatus = peerStatus
+}
+
+// GetPeerStatus returns the status of every peer that relayed some status, sorted by address
+func (whisper *Whisper) GetPeerStatus() []*PeerStatus {
+	whisper.routingHandler.mutex.RLock()
+	defer whisper.routingHandler.mutex.RUnlock()
+
+	peers := make(map[string]*PeerStatus)
+	for peer, status := range whisper.routingHandler.peerStatus {
+		peers[peer] = &PeerStatus{Address: peer, Bloom: status.Bloom, Pow: status.Pow, MaxMsgSize: status.MaxMsgSize}
+	}
+
+	for _, status := range whisper.routingHandler.originStatus {
+		if peer, loaded := peers[status.Address]; loaded {
+			peer.Origins++
+			if status.LastSeen.After(peer.LastStatus) {
+				peer.LastStatus = status.LastSeen
+			}
+		}
+	}
+
+	peerStatus := make([]*PeerStatus, 0, len(peers))
+	for _, peer := range peers {
+		peerStatus = append(peerStatus, peer)
+	}
+
+	sort.Slice(peerStatus, func(i, j int) bool {
+		return peerStatus[i].Address < peerStatus[j].Address
+	})
+
+	return peerStatus
+}
+
+// getMaxPeerPow returns the highest pow required by the peers
+func (routingHandler *RoutingHandler) getMaxPeerPow() float64 {
+	routingHandler.mutex.RLock()
+	defer routingHandler.mutex.RUnlock()
+
+	maxPow := 0.0
+	for _, status := range routingHandler.peerStatus {
+		maxPow = math.Max(maxPow, status.Pow)
+	}
+	return maxPow
+}
+
+// isInterestingForPeers checks if some peer (except the one it came from) wants the envelope
+func (routingHandler *RoutingHandler) isInterestingForPeers(envelope *Envelope, origin *net.UDPAddr) bool {
+	routingHandler.mutex.RLock()
+	defer routingHandler.mutex.RUnlock()
+
+	for peer, status := range routingHandler.peerStatus {
+		if peer != origin.String() && status.accepts(envelope) {
+			return true
+		}
+	}
+	return false
+}
+
+// accepts checks if the envelope matches topics (or bloom), pow and size required by the peer
+func (status *Status) accepts(envelope *Envelope) bool {
+	if status.MaxMsgSize > 0 && uint32(envelope.GetSize()) > status.MaxMsgSize {
+		return false
+	}
+
+	if envelope.GetPow() < status.Pow {
+		return false
+	}
+
+	// prefer exact matching, fall back to bloom for peers not advertising topics
+	if status.Topics != nil {
+		_, interested := status.Topics[envelope.Topic]
+		return interested
+	}
+	return CheckFilterMatch(status.Bloom, envelope.GetBloom())
+}
+
+// copyTopics returns a copy of the topic set
+func copyTopics(topics map[Topic]struct{}) map[Topic]struct{} {
+	if topics == nil {
+		return nil
+	}
+	topicsCopy := make(map[Topic]struct{}, len(topics))
+	for topic := range topics {
+		topicsCopy[topic] = struct{}{}
+	}
+	return topicsCopy
+}
+
 // check if packet is new (has higher id) from that source, in that case it updates the table
 func (routingHandler *RoutingHandler) updateLastOriginID(origin string, id uint32) bool {
 	isNew := false
@@ -93,31 +290,16 @@ func (routingHandler *RoutingHandler) updateLastOriginID(origin string, id uint3
 	return isNew
 }
 
-// forward envelope according to routing table and only to peers that might be interested
-func (whisper *Whisper) forwardEnvelope(envOr *EnvelopeOrigin) {
-
-	envelope := envOr.Envelope
-	packetToSend, _ := protobuf.Encode(envelope)
-	packet := &gossiper.GossipPacket{WhisperPacket: &gossiper.WhisperPacket{Code: messagesCode, Payload: packetToSend, Size: uint32(len(packetToSend))}}
-
-	whisper.routingHandler.mutex.RLock()
-	defer whisper.routingHandler.mutex.RUnlock()
-
-	for peer, status := range whisper.routingHandler.peerStatus {
-		if peer != envOr.Origin.String() {
-			//fmt.Println(status.Bloom)
-			//fmt.Println(envelope.GetBloom())
-			//fmt.Println(CheckFilterMatch(status.Bloom, envelope.GetBloom()))
-			//fmt.Println(fmt.Sprint(envelope.GetPow()) + " | " + fmt.Sprint(status.Pow))
-			if CheckFilterMatch(status.Bloom, envelope.GetBloom()) && envelope.GetPow() >= status.Pow {
-				//fmt.Println("Passed check")
-				address := whisper.gossiper.GetPeerFromString(peer)
-				if address != nil {
-					//fmt.Println("\nWhisper: packet forwarded to peer " + address.String())
-					whisper.gossiper.ConnectionHandler.SendPacket(packet, address)
-				}
-			}
-		}
+// createStatus with all the current parameters of this node
+func (whisper *Whisper) createStatus() *gossiper.WhisperStatus {
+	topics := whisper.GetTopicInterest()
+	return &gossiper.WhisperStatus{
+		Code:          statusCode,
+		Pow:           whisper.GetMinPow(),
+		Bloom:         whisper.GetBloomFilter(),
+		MaxMsgSize:    whisper.GetMaxMessageSize(),
+		Topics:        convertTopicsToBytes(topics),
+		TopicInterest: topics != nil,
 	}
 }
 
@@ -126,8 +308,7 @@ func (whisper *Whisper) sendStatusPeriodically() {
 
 	if statusTimer > 0 {
 
-		wPacket := &gossiper.WhisperStatus{Code: statusCode, Pow: whisper.GetMinPow(), Bloom: whisper.GetBloomFilter()}
-		whisper.gossiper.SendWhisperStatus(wPacket)
+		whisper.gossiper.SendWhisperStatus(whisper.createStatus())
 
 		//fmt.Println("Sent status")
 
@@ -138,8 +319,7 @@ func (whisper *Whisper) sendStatusPeriodically() {
 			// rumor monger rumor at each timeout
 			case <-timer.C:
 				//fmt.Println("Sent status")
-				wPacket := &gossiper.WhisperStatus{Code: statusCode, Pow: whisper.GetMinPow(), Bloom: whisper.GetBloomFilter()}
-				whisper.gossiper.SendWhisperStatus(wPacket)
+				whisper.gossiper.SendWhisperStatus(whisper.createStatus())
 			}
 		}
 	}
@@ -0,0 +1,60 @@
+/* Contributors: Andrea Piccione */
+
+package whisper
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Subscription delivers the messages of a filter as soon as they are received and decrypted
+type Subscription struct {
+	ID string
+
+	messages    chan *ReceivedMessage
+	err         chan error
+	unsubscribe func()
+	once        sync.Once
+}
+
+// newSubscription creates a subscription with buffered channels
+func newSubscription() *Subscription {
+	return &Subscription{
+		messages: make(chan *ReceivedMessage, subscriptionBufferSize),
+		err:      make(chan error, 1),
+	}
+}
+
+// Messages returns the channel where new messages are pushed, it's closed on unsubscribe
+func (sub *Subscription) Messages() <-chan *ReceivedMessage {
+	return sub.messages
+}
+
+// Err returns the channel where errors are reported (e.g. messages dropped because the consumer is too slow), it's closed on unsubscribe
+func (sub *Subscription) Err() <-chan error {
+	return sub.err
+}
+
+// Unsubscribe removes the filter and closes the channels, can be called more than once
+func (sub *Subscription) Unsubscribe() {
+	sub.once.Do(func() {
+		// once the filter is removed no more messages are delivered
+		if sub.unsubscribe != nil {
+			sub.unsubscribe()
+		}
+		close(sub.messages)
+		close(sub.err)
+	})
+}
+
+// deliver pushes the message without blocking, if the buffer is full the message is dropped and an error reported
+func (sub *Subscription) deliver(msg *ReceivedMessage) {
+	select {
+	case sub.messages <- msg:
+	default:
+		select {
+		case sub.err <- fmt.Errorf("subscription buffer full, messages dropped"):
+		default:
+		}
+	}
+}
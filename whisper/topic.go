@@ -41,4 +41,16 @@ func ConvertTopicToBloom(topic Topic) []byte {
 		b[byteIndex] = (1 << uint(bitIndex))
 	}
 	return b
-}
\ No newline at end of file
+}
+// convertTopicsToBytes converts topics to byte slices to be sent in status packets
+func convertTopicsToBytes(topics []Topic) [][]byte {
+	if topics == nil {
+		return nil
+	}
+	topicsBytes := make([][]byte, len(topics))
+	for i, topic := range topics {
+		topicsBytes[i] = make([]byte, TopicLength)
+		copy(topicsBytes[i], topic[:])
+	}
+	return topicsBytes
+}
@@ -25,6 +25,12 @@ func generateRandomID() (id string, err error) {
 	return id, err
 }
 
+// isValidKeyID checks that the id has the format of the generated ones, ids are used as file names in the key store
+func isValidKeyID(id string) bool {
+	decoded, err := hex.DecodeString(id)
+	return err == nil && len(decoded) == keyIDSize
+}
+
 func generateRandomBytes(length int) ([]byte, error) {
 	array := make([]byte, length)
 	_, err := crand.Read(array)
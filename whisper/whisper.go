@@ -3,6 +3,7 @@
 package whisper
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/dedis/protobuf"
 	"github.com/mikanikos/DSignal/gossiper"
@@ -34,12 +35,23 @@ type Whisper struct {
 	filters *FilterStorage
 	// crypto keys (both private and symmetric) storage with unique id
 	cryptoKeys sync.Map
+	// persistent storage of the crypto keys, if open
+	keyStore *KeyStore
 	// envelopes which are not expired yet
 	envelopes *SafeEnvelopes
 	// routing envelopes according to received bloom filters
 	routingHandler *RoutingHandler
-	// blacklist of peers
-	blacklist map[string]struct{}
+	// score of the peers, misbehaving peers get banned for a while
+	reputationHandler *ReputationHandler
+	// limit the rate of incoming packets per peer, per ip and globally
+	rateLimiter *RateLimiter
+	// envelopes known by each peer, only the missing ones are sent
+	inventoryHandler *InventoryHandler
+	// archive of envelopes, only in mail server mode
+	mailServer *MailServer
+	// mail servers asked for historic envelopes, until their reply is complete
+	mailRequests      map[string]*pendingMailRequest
+	mailRequestsMutex sync.Mutex
 
 	messageQueue chan *Envelope
 	quit         chan struct{} // channel used for graceful exit
@@ -49,15 +61,18 @@ type Whisper struct {
 func NewWhisper(g *gossiper.Gossiper) *Whisper {
 
 	whisper := &Whisper{
-		gossiper:       g,
-		parameters:     sync.Map{},
-		cryptoKeys:     sync.Map{},
-		envelopes:      &SafeEnvelopes{Envelopes: make(map[[32]byte]*EnvelopeOrigin)},
-		filters:        NewFilterStorage(),
-		routingHandler: NewRoutingHandler(),
-		messageQueue:   make(chan *Envelope, messageQueueLimit),
-		quit:           make(chan struct{}),
-		blacklist:      make(map[string]struct{}),
+		gossiper:          g,
+		parameters:        sync.Map{},
+		cryptoKeys:        sync.Map{},
+		envelopes:         &SafeEnvelopes{Envelopes: make(map[[32]byte]*EnvelopeOrigin)},
+		filters:           NewFilterStorage(),
+		routingHandler:    NewRoutingHandler(),
+		messageQueue:      make(chan *Envelope, messageQueueLimit),
+		quit:              make(chan struct{}),
+		reputationHandler: NewReputationHandler(),
+		rateLimiter:       NewRateLimiter(),
+		inventoryHandler:  NewInventoryHandler(),
+		mailRequests:      make(map[string]*pendingMailRequest),
 	}
 
 	whisper.parameters.Store(minPowIdx, DefaultMinimumPoW)
@@ -74,6 +89,9 @@ func (whisper *Whisper) SendEnvelope(envelope *Envelope) error {
 		fmt.Println(err)
 		return fmt.Errorf("failed to handle Envelope envelope, %s", err)
 	}
+
+	// no peer can have my new envelope yet, no need to wait for the announcement
+	whisper.pushEnvelope(envelope)
 	return err
 }
 
@@ -83,6 +101,10 @@ func (whisper *Whisper) Run() {
 	go whisper.processWhisperStatus()
 	go whisper.updateEnvelopes()
 	go whisper.sendStatusPeriodically()
+	go whisper.handleRemovedPeers(whisper.gossiper.SubscribePeerRemoval())
+
+	// misbehaving peers are the first to be dropped when the gossiper needs room
+	whisper.gossiper.SetPeerScorer(whisper.reputationHandler.getScore)
 
 	numCPU := runtime.NumCPU()
 	for i := 0; i < numCPU; i++ {
@@ -97,12 +119,27 @@ func (whisper *Whisper) Stop() error {
 	return nil
 }
 
+// forget the routes and the inventory of the peers evicted by the gossiper
+func (whisper *Whisper) handleRemovedPeers(removedPeers chan *net.UDPAddr) {
+	for peer := range removedPeers {
+		whisper.routingHandler.removePeer(peer.String())
+		whisper.inventoryHandler.removePeer(peer.String())
+	}
+}
+
 // process incoming whisper status
 func (whisper *Whisper) processWhisperStatus() {
 	for extPacket := range gossiper.PacketChannels["whisperStatus"] {
 		//fmt.Println("\nWhisper: received status packet from peer " + extPacket.SenderAddr.String())
-		if _, loaded := whisper.blacklist[extPacket.SenderAddr.String()]; !loaded {
-			whisper.routingHandler.updateRoutingTable(extPacket.Packet.WhisperStatus, extPacket.SenderAddr)
+		if whisper.reputationHandler.isBanned(extPacket.SenderAddr.String()) {
+			continue
+		}
+
+		if whisper.allowPacket(extPacket.SenderAddr, getStatusSize(extPacket.Packet.WhisperStatus)) {
+			// my own status coming back is not a route
+			if extPacket.Packet.WhisperStatus.Origin != whisper.gossiper.Name {
+				whisper.routingHandler.updateRoutingTable(extPacket.Packet.WhisperStatus, extPacket.SenderAddr)
+			}
 			whisper.gossiper.HandleGossipMessage(extPacket, extPacket.Packet.WhisperStatus.Origin, extPacket.Packet.WhisperStatus.ID)
 		}
 	}
@@ -112,31 +149,70 @@ func (whisper *Whisper) processWhisperStatus() {
 func (whisper *Whisper) processWhisperPacket() {
 	for extPacket := range gossiper.PacketChannels["whisperPacket"] {
 		//fmt.Println("\nWhisper: received envelope from peer " + extPacket.SenderAddr.String())
-		if _, loaded := whisper.blacklist[extPacket.SenderAddr.String()]; !loaded {
+		if whisper.reputationHandler.isBanned(extPacket.SenderAddr.String()) {
+			continue
+		}
+
+		// check limits before decoding anything
+		if whisper.allowPacket(extPacket.SenderAddr, len(extPacket.Packet.WhisperPacket.Payload)) {
 
 			packet := extPacket.Packet.WhisperPacket
 
-			if packet.Code == messagesCode {
+			switch packet.Code {
+			case messagesCode:
 				// decode the contained envelope
 
 				envelope := &Envelope{}
 
 				err := protobuf.Decode(packet.Payload, envelope)
 				if err != nil {
-					fmt.Println(err)
+					whisper.penalizePeer(extPacket.SenderAddr.String(), undecodableViolation)
+					continue
 				}
 
+				// the peer has it, no need to announce it back
+				whisper.inventoryHandler.envelopeReceived(extPacket.SenderAddr.String(), envelope.GetHash(), envelope.Expiry)
+
 				err = whisper.handleEnvelope(&EnvelopeOrigin{Envelope: envelope, Origin: extPacket.SenderAddr})
+				if envErr, ok := err.(*envelopeError); ok {
+					whisper.penalizePeer(extPacket.SenderAddr.String(), envErr.violation)
+				}
+
+			case inventoryCode:
+				err := whisper.handleInventory(packet.Payload, extPacket.SenderAddr)
+				if envErr, ok := err.(*envelopeError); ok {
+					whisper.penalizePeer(extPacket.SenderAddr.String(), envErr.violation)
+				}
+
+			case getEnvelopesCode:
+				err := whisper.handleEnvelopesRequest(packet.Payload, extPacket.SenderAddr)
+				if envErr, ok := err.(*envelopeError); ok {
+					whisper.penalizePeer(extPacket.SenderAddr.String(), envErr.violation)
+				}
+
+			case p2pRequestCode:
+				err := whisper.handleMailRequest(packet.Payload, extPacket.SenderAddr)
+				if err != nil {
+					fmt.Println("\nWhisper: failed to serve historic envelopes to peer " + extPacket.SenderAddr.String() + ": " + err.Error())
+				}
+
+			case p2pMessageCode:
+				err := whisper.handleP2PEnvelope(packet.Payload, extPacket.SenderAddr)
 				if err != nil {
-					fmt.Println("\nWhisper: bad envelope received, peer " + extPacket.SenderAddr.String() + " will be disconnected")
-					//fmt.Println(err)
-					whisper.blacklist[extPacket.SenderAddr.String()] = struct{}{}
+					fmt.Println("\nWhisper: direct envelope from peer " + extPacket.SenderAddr.String() + " dropped: " + err.Error())
 				}
 			}
 		}
 	}
 }
 
+// penalizePeer for the violation, printing when the peer gets banned
+func (whisper *Whisper) penalizePeer(peer string, violation Violation) {
+	if whisper.reputationHandler.penalize(peer, violation) {
+		fmt.Println("\nWhisper: peer " + peer + " banned temporarily, last violation: " + violation.String())
+	}
+}
+
 // GetEnvelope retrieves an envelope from its hash
 func (whisper *Whisper) GetEnvelope(hash [32]byte) *EnvelopeOrigin {
 	whisper.envelopes.Mutex.RLock()
@@ -162,6 +238,33 @@ func (whisper *Whisper) GetMinPowTolerated() float64 {
 	return val.(float64)
 }
 
+// GetMaxMessageSize returns the maximum size of the envelopes accepted
+func (whisper *Whisper) GetMaxMessageSize() uint32 {
+	val, loaded := whisper.parameters.Load(maxMsgSizeIdx)
+	if !loaded {
+		return DefaultMaxMessageSize
+	}
+	return val.(uint32)
+}
+
+// GetMaxMessageSizeTolerated returns the maximum size tolerated for a limited time
+func (whisper *Whisper) GetMaxMessageSizeTolerated() uint32 {
+	val, exist := whisper.parameters.Load(maxMsgSizeToleranceIdx)
+	if !exist || val == nil {
+		return DefaultMaxMessageSize
+	}
+	return val.(uint32)
+}
+
+// GetTopicInterest returns the topics advertised to peers, nil if only the bloom filter is advertised
+func (whisper *Whisper) GetTopicInterest() []Topic {
+	value, loaded := whisper.parameters.Load(topicInterestIdx)
+	if !loaded || value == nil {
+		return nil
+	}
+	return value.([]Topic)
+}
+
 // GetBloomFilter returns the aggregated bloom filter for all the topics of interest
 func (whisper *Whisper) GetBloomFilter() []byte {
 	value, loaded := whisper.parameters.Load(bloomFilterIdx)
@@ -180,8 +283,23 @@ func (whisper *Whisper) GetBloomFilterTolerated() []byte {
 	return val.([]byte)
 }
 
-// SetBloomFilter sets the new bloom filter
+// SetBloomFilter sets the new bloom filter, it's not recomputed anymore when filters are deleted
 func (whisper *Whisper) SetBloomFilter(bloom []byte) error {
+	if len(bloom) != BloomFilterSize {
+		return fmt.Errorf("invalid bloom filter GetSize")
+	}
+	whisper.parameters.Store(bloomFilterSetIdx, true)
+	return whisper.setBloomFilter(bloom)
+}
+
+// isBloomFilterSet checks if the bloom filter was set explicitly
+func (whisper *Whisper) isBloomFilterSet() bool {
+	_, loaded := whisper.parameters.Load(bloomFilterSetIdx)
+	return loaded
+}
+
+// setBloomFilter stores and announces the new bloom filter
+func (whisper *Whisper) setBloomFilter(bloom []byte) error {
 
 	if len(bloom) != BloomFilterSize {
 		return fmt.Errorf("invalid bloom filter GetSize")
@@ -221,6 +339,77 @@ func (whisper *Whisper) SetMinPoW(pow float64) error {
 	return nil
 }
 
+// SetMaxMessageSize sets the maximum size of the envelopes accepted by this node
+func (whisper *Whisper) SetMaxMessageSize(size uint32) error {
+	if size == 0 || size > MaxMessageSize {
+		return fmt.Errorf("invalid max message size")
+	}
+
+	whisper.parameters.Store(maxMsgSizeIdx, size)
+
+	wPacket := &gossiper.WhisperStatus{Code: maxMsgSizeCode, MaxMsgSize: size}
+	whisper.gossiper.SendWhisperStatus(wPacket)
+
+	go func() {
+		// let peers receive notification
+		time.Sleep(time.Duration(DefaultSyncAllowance) * time.Second)
+		whisper.parameters.Store(maxMsgSizeToleranceIdx, size)
+	}()
+
+	return nil
+}
+
+// SetTopicInterest sets the exact topics advertised to peers, nil to advertise only the bloom filter
+func (whisper *Whisper) SetTopicInterest(topics []Topic) error {
+	if len(topics) > maxTopicInterest {
+		return fmt.Errorf("too many topics")
+	}
+
+	var value interface{}
+	if topics != nil {
+		value = topics
+	}
+	whisper.parameters.Store(topicInterestIdx, value)
+
+	wPacket := &gossiper.WhisperStatus{Code: topicInterestCode, Topics: convertTopicsToBytes(topics), TopicInterest: topics != nil}
+	whisper.gossiper.SendWhisperStatus(wPacket)
+
+	return nil
+}
+
+// updateTopicInterest advertises the topics of the filters if they changed
+func (whisper *Whisper) updateTopicInterest() {
+	// a mail server is interested in every envelope
+	if whisper.mailServer != nil {
+		return
+	}
+
+	topics := whisper.filters.getTopics()
+	if len(topics) > maxTopicInterest {
+		topics = nil
+	}
+
+	current := whisper.GetTopicInterest()
+	if topics != nil && current != nil && len(topics) == len(current) {
+		changed := false
+		for i := range topics {
+			if topics[i] != current[i] {
+				changed = true
+				break
+			}
+		}
+		if !changed {
+			return
+		}
+	}
+
+	if topics == nil && current == nil {
+		return
+	}
+
+	whisper.SetTopicInterest(topics)
+}
+
 // updateBloomFilter recomputes bloom filter
 func (whisper *Whisper) updateBloomFilter(f *Filter) {
 	aggregate := make([]byte, BloomFilterSize)
@@ -235,7 +424,21 @@ func (whisper *Whisper) updateBloomFilter(f *Filter) {
 
 	if !CheckFilterMatch(whisper.GetBloomFilter(), aggregate) {
 		aggregate = AggregateBloom(whisper.GetBloomFilter(), aggregate)
-		whisper.SetBloomFilter(aggregate)
+		whisper.setBloomFilter(aggregate)
+	}
+}
+
+// recomputeBloomFilter aggregates the bloom filter from the remaining filters and announces it if it shrank.
+// A bloom filter set explicitly is kept
+func (whisper *Whisper) recomputeBloomFilter() {
+	// a mail server is interested in every envelope
+	if whisper.mailServer != nil || whisper.isBloomFilterSet() {
+		return
+	}
+
+	aggregate := whisper.filters.getAggregatedBloom()
+	if !bytes.Equal(aggregate, whisper.GetBloomFilter()) {
+		whisper.setBloomFilter(aggregate)
 	}
 }
 
@@ -245,52 +448,44 @@ func (whisper *Whisper) handleEnvelope(envelopeOrigin *EnvelopeOrigin) error {
 
 	envelope := envelopeOrigin.Envelope
 
-	isInterestingForPeers := false
-	for peer, status := range whisper.routingHandler.peerStatus {
-		if peer != envelopeOrigin.Origin.String() && CheckFilterMatch(status.Bloom, envelope.GetBloom()) && envelope.GetPow() >= status.Pow {
-			isInterestingForPeers = true
-			break
-		}
-	}
-
-	var err error
-
 	sent := envelope.Expiry - envelope.TTL
 
+	// violations are never accepted, even if some peer would be interested
 	if sent > now {
 		if sent-DefaultSyncAllowance > now {
-			err = fmt.Errorf("envelope created in the future")
+			return &envelopeError{violation: timestampViolation, message: "envelope created in the future"}
 		}
 		envelope.computePow(sent - now + 1)
 	}
 
 	if envelope.Expiry < now {
 		if envelope.Expiry+DefaultSyncAllowance*2 < now {
-			err = fmt.Errorf("very old message")
+			return &envelopeError{violation: timestampViolation, message: "very old message"}
 		}
 		fmt.Println("\nWhisper: expired envelope dropped")
 	}
 
-	if uint32(envelope.GetSize()) > MaxMessageSize {
-		err = fmt.Errorf("huge messages are not allowed")
+	// the size limit is always enforced, peers not aware yet of a lower limit are not penalized
+	if uint32(envelope.GetSize()) > whisper.GetMaxMessageSize() {
+		if uint32(envelope.GetSize()) > whisper.GetMaxMessageSizeTolerated() {
+			return &envelopeError{violation: oversizeViolation, message: "huge messages are not allowed"}
+		}
+		return fmt.Errorf("envelope bigger than the maximum message size")
 	}
 
 	if envelope.GetPow() < whisper.GetMinPow() {
 		if envelope.GetPow() < whisper.GetMinPowTolerated() {
-			err = fmt.Errorf("\nWhisper: envelope with low pow received: " + fmt.Sprint(envelope.GetPow()))
+			return &envelopeError{violation: lowPowViolation, message: "envelope with low pow received: " + fmt.Sprint(envelope.GetPow())}
 		}
 	}
 
+	// envelopes I'm not interested in are still relayed if some peer wants them
 	if !CheckFilterMatch(whisper.GetBloomFilter(), envelope.GetBloom()) {
-		if !CheckFilterMatch(whisper.GetBloomFilterTolerated(), envelope.GetBloom()) {
-			err = fmt.Errorf("\nWhisper: envelope does not match bloom filter")
+		if !CheckFilterMatch(whisper.GetBloomFilterTolerated(), envelope.GetBloom()) && !whisper.routingHandler.isInterestingForPeers(envelope, envelopeOrigin.Origin) {
+			return fmt.Errorf("\nWhisper: envelope does not match bloom filter")
 		}
 	}
 
-	if err != nil && !isInterestingForPeers {
-		return err
-	}
-
 	hash := envelope.GetHash()
 
 	whisper.envelopes.Mutex.Lock()
@@ -310,6 +505,14 @@ func (whisper *Whisper) handleEnvelope(envelopeOrigin *EnvelopeOrigin) error {
 
 	whisper.envelopes.Mutex.Unlock()
 
+	// keep envelopes beyond their expiry if running as mail server
+	if !loaded && whisper.mailServer != nil {
+		err := whisper.mailServer.archiveEnvelope(envelope)
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+
 	return nil
 }
 
@@ -327,20 +530,34 @@ func (whisper *Whisper) processQueue() {
 	}
 }
 
-// updateEnvelopes periodically broadcast and flush envelopes
+// updateEnvelopes periodically announce and flush envelopes
 func (whisper *Whisper) updateEnvelopes() {
 	expire := time.NewTicker(expirationTimer)
 	defer expire.Stop()
 	transmit := time.NewTicker(broadcastTimer)
 	defer transmit.Stop()
+	prune := time.NewTicker(archivePruneTimer)
+	defer prune.Stop()
 
 	for {
 		select {
 		case <-expire.C:
 			whisper.removeExpiredEnvelopes()
+			whisper.routingHandler.removeExpiredStatus()
+			whisper.reputationHandler.removeForgottenPeers()
+			whisper.rateLimiter.removeIdleBuckets()
+			whisper.inventoryHandler.removeExpiredInventory()
+			whisper.filters.removeExpiredParts()
+			whisper.removeExpiredMailRequests()
 
 		case <-transmit.C:
-			whisper.broadcastMessages()
+			whisper.announceEnvelopes()
+			whisper.requestMissingEnvelopes()
+
+		case <-prune.C:
+			if whisper.mailServer != nil {
+				whisper.mailServer.removeOldEnvelopes()
+			}
 
 		case <-whisper.quit:
 			return
@@ -348,14 +565,6 @@ func (whisper *Whisper) updateEnvelopes() {
 	}
 }
 
-// broadcastMessages broadcast messages not expired yet
-func (whisper *Whisper) broadcastMessages() {
-	envelopes := whisper.Envelopes()
-	for _, env := range envelopes {
-		whisper.forwardEnvelope(env)
-	}
-}
-
 // removeExpiredEnvelopes removes expired envelopes
 func (whisper *Whisper) removeExpiredEnvelopes() {
 	whisper.envelopes.Mutex.Lock()